@@ -22,6 +22,7 @@ import (
 type Authenticator struct {
 	bucket          base.Bucket
 	channelComputer ChannelComputer
+	logCtx          *base.LogContext // Tags log messages, e.g. with the current request's ID
 }
 
 // Interface for deriving the set of channels a User/Role has access to.
@@ -42,6 +43,14 @@ func NewAuthenticator(bucket base.Bucket, channelComputer ChannelComputer) *Auth
 	}
 }
 
+// Returns a copy of the Authenticator whose log messages (and those of the Users it returns)
+// are tagged with the given context.
+func (auth *Authenticator) WithLogContext(ctx *base.LogContext) *Authenticator {
+	copied := *auth
+	copied.logCtx = ctx
+	return &copied
+}
+
 func docIDForUserEmail(email string) string {
 	return "useremail:" + email
 }
@@ -151,7 +160,7 @@ func (auth *Authenticator) Save(p Principal) error {
 			//FIX: Unregister old email address if any
 		}
 	}
-	base.LogTo("Auth", "Saved %s: %s", p.docID(), data)
+	auth.logCtx.LogTo("Auth", "Saved %s: %s", p.docID(), data)
 	return nil
 }
 
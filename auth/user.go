@@ -182,7 +182,7 @@ func (user *userImpl) GetRoles() []Role {
 		roles := make([]Role, 0, len(user.RoleNames_))
 		for _, name := range user.RoleNames_ {
 			role, err := user.auth.GetRole(name)
-			base.LogTo("Auth", "User %s role %q = %v", user.Name_, name, role)
+			user.auth.logCtx.LogTo("Auth", "User %s role %q = %v", user.Name_, name, role)
 			if err != nil {
 				panic(fmt.Sprintf("Error getting user role %q: %v", name, err))
 			} else if role != nil {
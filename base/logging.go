@@ -10,11 +10,13 @@
 package base
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
 	"strings"
+	"time"
 )
 
 // 1 enables regular logs, 2 enables warnings, 3+ is nothing but panics.
@@ -24,10 +26,14 @@ var LogLevel int = 1
 // Set of LogTo() key strings that are enabled.
 var LogKeys map[string]bool
 
-var logger *log.Logger
+var logger, jsonLogger *log.Logger
+
+// If true, log messages are written as JSON objects, one per line, instead of as text.
+var logJSON bool
 
 func init() {
 	logger = log.New(os.Stderr, "", log.Lmicroseconds)
+	jsonLogger = log.New(os.Stderr, "", 0)
 	LogKeys = make(map[string]bool)
 }
 
@@ -36,8 +42,14 @@ func LogNoColor() {
 	reset, dim, fgRed, fgYellow = "", "", "", ""
 }
 
+// Switches to structured log output: one JSON object per line, with "timestamp", "level" and
+// "message" properties, plus "key", "request_id", "database", "user" and "caller" when known.
+func LogJSON() {
+	logJSON = true
+}
+
 // Parses a comma-separated list of log keys, probably coming from an argv flag.
-// The key "bw" is interpreted as a call to LogNoColor, not a key.
+// The keys "bw" and "json" are interpreted as calls to LogNoColor and LogJSON, not keys.
 func ParseLogFlag(flag string) {
 	if flag != "" {
 		ParseLogFlags(strings.Split(flag, ","))
@@ -45,11 +57,13 @@ func ParseLogFlag(flag string) {
 }
 
 // Parses an array of log keys, probably coming from a argv flags.
-// The key "bw" is interpreted as a call to LogNoColor, not a key.
+// The keys "bw" and "json" are interpreted as calls to LogNoColor and LogJSON, not keys.
 func ParseLogFlags(flags []string) {
 	for _, key := range flags {
 		if key == "bw" {
 			LogNoColor()
+		} else if key == "json" {
+			LogJSON()
 		} else {
 			LogKeys[key] = true
 			for strings.HasSuffix(key, "+") {
@@ -79,23 +93,19 @@ func GetCallersName(depth int) string {
 
 // Logs a message to the console, but only if the corresponding key is true in LogKeys.
 func LogTo(key string, format string, args ...interface{}) {
-	if LogLevel <= 1 && LogKeys[key] {
-		logger.Printf(fgYellow+key+": "+reset+format, args...)
-	}
+	(*LogContext)(nil).LogTo(key, format, args...)
 }
 
 // Logs a message to the console.
 func Log(format string, args ...interface{}) {
-	if LogLevel <= 1 {
-		logger.Printf(format, args...)
-	}
+	(*LogContext)(nil).Log(format, args...)
 }
 
 // If the error is not nil, logs its description and the name of the calling function.
 // Returns the input error for easy chaining.
 func LogError(err error) error {
 	if LogLevel <= 2 && err != nil {
-		logWithCaller(fgRed, "ERROR", "%v", err)
+		logWithCaller(nil, fgRed, "ERROR", "%v", err)
 	}
 	return err
 }
@@ -103,7 +113,7 @@ func LogError(err error) error {
 // Logs a warning to the console
 func Warn(format string, args ...interface{}) {
 	if LogLevel <= 2 {
-		logWithCaller(fgRed, "WARNING", format, args...)
+		logWithCaller(nil, fgRed, "WARNING", format, args...)
 	}
 }
 
@@ -111,25 +121,95 @@ func Warn(format string, args ...interface{}) {
 // temporary logging calls added during development and not to be checked in, hence its
 // distinctive name (which is visible and easy to search for before committing.)
 func TEMP(format string, args ...interface{}) {
-	logWithCaller(fgYellow, "TEMP", format, args...)
+	logWithCaller(nil, fgYellow, "TEMP", format, args...)
 }
 
 // Logs a warning to the console, then panics.
 func LogPanic(format string, args ...interface{}) {
-	logWithCaller(fgRed, "PANIC", format, args...)
+	logWithCaller(nil, fgRed, "PANIC", format, args...)
 	panic(fmt.Sprintf(format, args...))
 }
 
 // Logs a warning to the console, then exits the process.
 func LogFatal(format string, args ...interface{}) {
-	logWithCaller(fgRed, "FATAL", format, args...)
+	logWithCaller(nil, fgRed, "FATAL", format, args...)
 	os.Exit(1)
 }
 
-func logWithCaller(color string, prefix string, format string, args ...interface{}) {
+// Identifies the HTTP request, database and user that log messages are about. Any of its
+// fields may be empty, and a nil *LogContext is valid too. (Only JSON log output shows them.)
+type LogContext struct {
+	RequestID string
+	Database  string
+	User      string
+}
+
+// Like the LogTo function, but tags the message with the context.
+func (ctx *LogContext) LogTo(key string, format string, args ...interface{}) {
+	if LogLevel <= 1 && LogKeys[key] {
+		if logJSON {
+			logJSONEntry(ctx, "info", key, fmt.Sprintf(format, args...), "")
+		} else {
+			logger.Printf(fgYellow+key+": "+reset+format, args...)
+		}
+	}
+}
+
+// Like the Log function, but tags the message with the context.
+func (ctx *LogContext) Log(format string, args ...interface{}) {
+	if LogLevel <= 1 {
+		if logJSON {
+			logJSONEntry(ctx, "info", "", fmt.Sprintf(format, args...), "")
+		} else {
+			logger.Printf(format, args...)
+		}
+	}
+}
+
+// Like the Warn function, but tags the message with the context.
+func (ctx *LogContext) Warn(format string, args ...interface{}) {
+	if LogLevel <= 2 {
+		logWithCaller(ctx, fgRed, "WARNING", format, args...)
+	}
+}
+
+func logWithCaller(ctx *LogContext, color string, prefix string, format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
-	logger.Print(color, prefix, ": ", message, reset,
-		dim, " -- ", GetCallersName(2), reset)
+	if logJSON {
+		logJSONEntry(ctx, strings.ToLower(prefix), "", message, GetCallersName(2))
+	} else {
+		logger.Print(color, prefix, ": ", message, reset,
+			dim, " -- ", GetCallersName(2), reset)
+	}
+}
+
+// The JSON form of a log message.
+type logEntry struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Key       string `json:"key,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Database  string `json:"database,omitempty"`
+	User      string `json:"user,omitempty"`
+	Message   string `json:"message"`
+	Caller    string `json:"caller,omitempty"`
+}
+
+func logJSONEntry(ctx *LogContext, level, key, message, caller string) {
+	entry := logEntry{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     level,
+		Key:       key,
+		Message:   message,
+		Caller:    caller,
+	}
+	if ctx != nil {
+		entry.RequestID = ctx.RequestID
+		entry.Database = ctx.Database
+		entry.User = ctx.User
+	}
+	line, _ := json.Marshal(entry)
+	jsonLogger.Print(string(line))
 }
 
 func lastComponent(path string) string {
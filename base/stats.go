@@ -0,0 +1,239 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds (in seconds) of the buckets of a latency Histogram.
+var kLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25,
+	0.5, 1, 2.5, 5, 10}
+
+// A counter (or gauge) of some event or quantity. Thread-safe.
+type Counter struct {
+	value int64
+}
+
+func (c *Counter) Add(delta int64) {
+	atomic.AddInt64(&c.value, delta)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Records the distribution of a duration, like the latency of an operation. Thread-safe.
+type Histogram struct {
+	lock   sync.Mutex
+	counts []int64 // Number of observations in each of kLatencyBuckets (not cumulative)
+	count  int64
+	sum    float64
+}
+
+// Records a duration, in seconds.
+func (h *Histogram) Observe(seconds float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.counts == nil {
+		h.counts = make([]int64, len(kLatencyBuckets))
+	}
+	for i, bound := range kLatencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Records the time elapsed since 'start'. Handy as "defer h.ObserveSince(time.Now())".
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Returns the number of observations, their sum, and the cumulative count of observations
+// less than or equal to each bucket bound.
+func (h *Histogram) snapshot() (count int64, sum float64, cumulative []int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	cumulative = make([]int64, len(kLatencyBuckets))
+	var total int64
+	for i := range kLatencyBuckets {
+		if h.counts != nil {
+			total += h.counts[i]
+		}
+		cumulative[i] = total
+	}
+	return h.count, h.sum, cumulative
+}
+
+type metric struct {
+	kind      string // Prometheus metric type: "counter", "gauge" or "histogram"
+	help      string
+	counter   *Counter
+	histogram *Histogram
+}
+
+// A set of named runtime statistics. Thread-safe.
+type Stats struct {
+	lock    sync.Mutex
+	metrics map[string]*metric
+}
+
+func NewStats() *Stats {
+	return &Stats{metrics: map[string]*metric{}}
+}
+
+// Adds a Counter of events; by convention its name should end in "_total".
+func (s *Stats) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	s.add(name, &metric{kind: "counter", help: help, counter: c})
+	return c
+}
+
+// Adds a Counter of a quantity that can go up and down.
+func (s *Stats) NewGauge(name, help string) *Counter {
+	c := &Counter{}
+	s.add(name, &metric{kind: "gauge", help: help, counter: c})
+	return c
+}
+
+// Adds a Histogram of durations; by convention its name should end in "_seconds".
+func (s *Stats) NewHistogram(name, help string) *Histogram {
+	h := &Histogram{}
+	s.add(name, &metric{kind: "histogram", help: help, histogram: h})
+	return h
+}
+
+func (s *Stats) add(name string, m *metric) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.metrics[name] = m
+}
+
+func (s *Stats) get(name string) *metric {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.metrics[name]
+}
+
+func (s *Stats) names() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := make([]string, 0, len(s.metrics))
+	for name := range s.metrics {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Returns the current values as a map that can be marshaled as JSON. Counters are numbers;
+// histograms are objects with "count", "sum" and cumulative "buckets" properties.
+func (s *Stats) Snapshot() map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, name := range s.names() {
+		m := s.get(name)
+		if m.histogram != nil {
+			count, sum, cumulative := m.histogram.snapshot()
+			buckets := map[string]int64{}
+			for i, bound := range kLatencyBuckets {
+				buckets[formatFloat(bound)] = cumulative[i]
+			}
+			result[name] = map[string]interface{}{"count": count, "sum": sum, "buckets": buckets}
+		} else {
+			result[name] = m.counter.Value()
+		}
+	}
+	return result
+}
+
+// Writes sets of statistics in the Prometheus text exposition format. Each metric's name is
+// prefixed with 'prefix', and each set's samples get a label named 'labelName' whose value is
+// the set's key in 'sets' (or no label, if the key is "".)
+func WritePrometheus(w io.Writer, prefix, labelName string, sets map[string]*Stats) error {
+	keys := make([]string, 0, len(sets))
+	nameSet := map[string]bool{}
+	for key, stats := range sets {
+		keys = append(keys, key)
+		for _, name := range stats.names() {
+			nameSet[name] = true
+		}
+	}
+	sort.Strings(keys)
+	names := make([]string, 0, len(nameSet))
+	for name := range nameSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fullName := prefix + name
+		wroteHeader := false
+		for _, key := range keys {
+			m := sets[key].get(name)
+			if m == nil {
+				continue
+			}
+			if !wroteHeader {
+				fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", fullName, m.help, fullName, m.kind)
+				wroteHeader = true
+			}
+			label := ""
+			if key != "" {
+				label = fmt.Sprintf("%s=%q", labelName, key)
+			}
+			if m.histogram != nil {
+				count, sum, cumulative := m.histogram.snapshot()
+				for i, bound := range kLatencyBuckets {
+					fmt.Fprintf(w, "%s_bucket%s %d\n", fullName,
+						labels(label, fmt.Sprintf("le=%q", formatFloat(bound))), cumulative[i])
+				}
+				fmt.Fprintf(w, "%s_bucket%s %d\n", fullName, labels(label, `le="+Inf"`), count)
+				fmt.Fprintf(w, "%s_sum%s %s\n", fullName, labels(label), formatFloat(sum))
+				fmt.Fprintf(w, "%s_count%s %d\n", fullName, labels(label), count)
+			} else {
+				_, err := fmt.Fprintf(w, "%s%s %d\n", fullName, labels(label), m.counter.Value())
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Formats Prometheus labels like `{a="1",b="2"}`, skipping empty ones.
+func labels(items ...string) string {
+	result := ""
+	for _, item := range items {
+		if item == "" {
+			continue
+		} else if result != "" {
+			result += ","
+		}
+		result += item
+	}
+	if result == "" {
+		return ""
+	}
+	return "{" + result + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -24,6 +24,15 @@ func GenerateRandomSecret() string {
 	return fmt.Sprintf("%x", randomBytes)
 }
 
+// Returns a random identifier for an HTTP request, to tag its log messages with.
+func CreateRequestID() string {
+	randomBytes := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, randomBytes); err != nil {
+		panic("RNG failed, can't create request ID")
+	}
+	return fmt.Sprintf("%x", randomBytes)
+}
+
 // This is a workaround for an incompatibility between Go's JSON marshaler and CouchDB.
 // Go parses JSON numbers into float64 type, and then when it marshals float64 to JSON it uses
 // scientific notation if the number is more than six digits long, even if it's an integer.
@@ -3,8 +3,13 @@
 package base
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/sdegutis/go.assert"
+	"log"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFixJSONNumbers(t *testing.T) {
@@ -20,3 +25,54 @@ func TestFixJSONNumbers(t *testing.T) {
 	assert.DeepEquals(t, FixJSONNumbers(map[string]interface{}{"foo": float64(123456)}),
 		map[string]interface{}{"foo": int64(123456)})
 }
+
+func TestWritePrometheus(t *testing.T) {
+	stats := NewStats()
+	stats.NewCounter("hits_total", "Hits.").Add(3)
+	stats.NewHistogram("op_seconds", "Ops.").Observe(0.003)
+	assert.DeepEquals(t, stats.Snapshot()["hits_total"], int64(3))
+
+	var out bytes.Buffer
+	assert.Equals(t, WritePrometheus(&out, "x_", "db", map[string]*Stats{"db1": stats}), nil)
+	text := out.String()
+	assert.True(t, strings.Contains(text, "# TYPE x_hits_total counter\nx_hits_total{db=\"db1\"} 3\n"))
+	assert.True(t, strings.Contains(text, "x_op_seconds_bucket{db=\"db1\",le=\"0.0025\"} 0\n"))
+	assert.True(t, strings.Contains(text, "x_op_seconds_bucket{db=\"db1\",le=\"0.005\"} 1\n"))
+	assert.True(t, strings.Contains(text, "x_op_seconds_bucket{db=\"db1\",le=\"+Inf\"} 1\n"))
+	assert.True(t, strings.Contains(text, "x_op_seconds_count{db=\"db1\"} 1\n"))
+}
+
+func TestLogJSON(t *testing.T) {
+	var out bytes.Buffer
+	savedLogger, savedKeys := jsonLogger, LogKeys
+	jsonLogger = log.New(&out, "", 0)
+	LogKeys = map[string]bool{"CRUD": true}
+	logJSON = true
+	defer func() {
+		jsonLogger, LogKeys = savedLogger, savedKeys
+		logJSON = false
+	}()
+
+	ctx := &LogContext{RequestID: "abc123", Database: "db", User: "pupshaw"}
+	ctx.LogTo("CRUD", "Saved doc %q", "foo")
+	ctx.LogTo("Changes", "not logged")
+	var entry map[string]interface{}
+	assert.Equals(t, json.Unmarshal(out.Bytes(), &entry), nil)
+	assert.Equals(t, entry["level"], "info")
+	assert.Equals(t, entry["key"], "CRUD")
+	assert.Equals(t, entry["request_id"], "abc123")
+	assert.Equals(t, entry["database"], "db")
+	assert.Equals(t, entry["user"], "pupshaw")
+	assert.Equals(t, entry["message"], `Saved doc "foo"`)
+	_, err := time.Parse(time.RFC3339Nano, entry["timestamp"].(string))
+	assert.Equals(t, err, nil)
+
+	out.Reset()
+	Warn("Uh-oh")
+	entry = nil
+	assert.Equals(t, json.Unmarshal(out.Bytes(), &entry), nil)
+	assert.Equals(t, entry["level"], "warning")
+	assert.Equals(t, entry["message"], "Uh-oh")
+	assert.Equals(t, entry["request_id"], nil)
+	assert.True(t, strings.HasPrefix(entry["caller"].(string), "base.TestLogJSON()"))
+}
@@ -40,26 +40,30 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 		meta := value.(map[string]interface{})
 		data, exists := meta["data"]
 		if exists {
-			// Attachment contains data, so store it in the db:
-			attachment, err := decodeAttachment(data)
-			if err != nil {
-				return err
-			}
-			key, err := db.setAttachment(attachment)
-			if err != nil {
-				return err
+			// Attachment contains data, so store it in the db (unless that's already been done):
+			saved, ok := data.(savedAttachment)
+			if !ok {
+				attachment, err := decodeAttachment(data)
+				if err != nil {
+					return err
+				}
+				saved.key, err = db.setAttachment(attachment)
+				if err != nil {
+					return err
+				}
+				saved.length = len(attachment)
 			}
 			delete(meta, "data")
 			meta["stub"] = true
-			meta["length"] = len(attachment)
-			meta["digest"] = string(key)
+			meta["length"] = saved.length
+			meta["digest"] = string(saved.key)
 			meta["revpos"] = generation
 		} else {
 			// No data given; look it up from the parent revision.
 			if parentAttachments == nil {
 				parent, err := db.getAvailableRev(doc, parentRev)
 				if err != nil {
-					base.Warn("storeAttachments: no such parent rev %q to find %v", parentRev, meta)
+					db.logCtx.Warn("storeAttachments: no such parent rev %q to find %v", parentRev, meta)
 					return err
 				}
 				parentAttachments, exists = parent["_attachments"].(map[string]interface{})
@@ -77,6 +81,29 @@ func (db *Database) storeAttachments(doc *document, body Body, generation int, p
 	return nil
 }
 
+// Decodes the inline bodies of a document body's attachments and replaces them with references
+// to where they'll be stored, adding the data to 'pending' without storing it yet. This lets
+// UpdateAllOrNothing check a batch of updates before writing anything to the bucket.
+func prepareAttachments(body Body, pending map[AttachmentKey][]byte) error {
+	for _, value := range BodyAttachments(body) {
+		meta := value.(map[string]interface{})
+		data, exists := meta["data"]
+		if !exists {
+			continue
+		} else if _, ok := data.(savedAttachment); ok {
+			continue
+		}
+		attachment, err := decodeAttachment(data)
+		if err != nil {
+			return err
+		}
+		key := AttachmentKey(sha1DigestKey(attachment))
+		pending[key] = attachment
+		meta["data"] = savedAttachment{key: key, length: len(attachment)}
+	}
+	return nil
+}
+
 // Goes through a revisions '_attachments' map, loads attachments (by their 'digest' properties)
 // and adds 'data' properties containing the data. The data is added as raw []byte; the JSON
 // marshaler will convert that to base64.
@@ -109,7 +136,7 @@ func (db *Database) setAttachment(attachment []byte) (AttachmentKey, error) {
 	key := AttachmentKey(sha1DigestKey(attachment))
 	_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, attachment)
 	if err == nil {
-		base.LogTo("Attach", "\tAdded attachment %q", key)
+		db.logCtx.LogTo("Attach", "\tAdded attachment %q", key)
 	}
 	return key, err
 }
@@ -189,70 +216,148 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 		return nil, err
 	}
 
-	digestIndex := map[string]string{} // maps digests -> names
+	// Now read the "following" attachments:
+	following := followingAttachments{}
+	if err = following.add(body); err != nil {
+		return nil, err
+	}
+	err = following.read(reader, func(data []byte) (interface{}, error) {
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
 
-	// Now look for "following" attachments:
-	attachments := BodyAttachments(body)
-	for name, value := range attachments {
-		meta := value.(map[string]interface{})
-		if meta["follows"] == true {
+// Reads a multipart _bulk_docs request. The first part is the JSON request body (or just the
+// array of docs); the following parts are the bodies of the docs' attachments that have
+// "follows":true, matched by digest. Each attachment is saved to the bucket as soon as it's read,
+// so only one has to be in memory at a time.
+func (db *Database) ReadMultipartBulkDocs(reader *multipart.Reader) (Body, error) {
+	mainPart, err := reader.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	var input interface{}
+	err = ReadJSONFromMIME(http.Header(mainPart.Header), mainPart, &input)
+	mainPart.Close()
+	if err != nil {
+		return nil, err
+	}
+	var body Body
+	switch input := input.(type) {
+	case map[string]interface{}:
+		body = input
+	case []interface{}:
+		body = Body{"docs": input}
+	}
+	docs, ok := body["docs"].([]interface{})
+	if !ok {
+		return nil, &base.HTTPError{http.StatusBadRequest, "Missing docs array"}
+	}
+
+	following := followingAttachments{}
+	for _, doc := range docs {
+		if doc, ok := doc.(map[string]interface{}); ok {
+			if err = following.add(doc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = following.read(reader, func(data []byte) (interface{}, error) {
+		key, err := db.setAttachment(data)
+		return savedAttachment{key: key, length: len(data)}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// Placeholder for the "data" property of an attachment whose data has already been saved to the
+// bucket, by ReadMultipartBulkDocs or CopyDoc. storeAttachments recognizes it.
+type savedAttachment struct {
+	key    AttachmentKey
+	length int
+}
+
+// Maps digests to the metadata of attachments marked "follows", whose data is in MIME parts
+// following the JSON body.
+type followingAttachments map[string][]map[string]interface{}
+
+// Adds the attachments of a document body that have "follows":true.
+func (following followingAttachments) add(body Body) error {
+	for _, value := range BodyAttachments(body) {
+		meta, ok := value.(map[string]interface{})
+		if ok && meta["follows"] == true {
 			digest, ok := meta["digest"].(string)
 			if !ok {
-				return nil, &base.HTTPError{http.StatusBadRequest, "Missing digest in attachment"}
+				return &base.HTTPError{http.StatusBadRequest, "Missing digest in attachment"}
 			}
-			digestIndex[digest] = name
+			following[digest] = append(following[digest], meta)
 		}
 	}
+	return nil
+}
 
+// Reads the remaining MIME parts, each of which must be the data of a following attachment. The
+// value returned by 'gotData' is stored as the "data" property of the matching attachments.
+func (following followingAttachments) read(reader *multipart.Reader, gotData func([]byte) (interface{}, error)) error {
 	// Read the parts one by one:
-	for i := 0; i < len(digestIndex); i++ {
+	for i := 0; i < len(following); i++ {
 		part, err := reader.NextPart()
 		if err != nil {
 			if err == io.EOF {
 				err = &base.HTTPError{http.StatusBadRequest, "Too few MIME parts"}
 			}
-			return nil, err
+			return err
 		}
 		data, err := ioutil.ReadAll(part)
 		part.Close()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// Look up the attachment by its digest:
 		digest := sha1DigestKey(data)
-		name, ok := digestIndex[digest]
+		metas, ok := following[digest]
 		if !ok {
-			name, ok = digestIndex[md5DigestKey(data)]
+			metas, ok = following[md5DigestKey(data)]
 		}
 		if !ok {
-			return nil, &base.HTTPError{http.StatusBadRequest,
+			return &base.HTTPError{http.StatusBadRequest,
 				fmt.Sprintf("MIME part #%d doesn't match any attachment", i+2)}
 		}
 
-		meta := attachments[name].(map[string]interface{})
-		length, ok := meta["encoded_length"].(float64)
-		if !ok {
-			length, ok = meta["length"].(float64)
-		}
-		if ok {
-			if int(length) != len(data) {
-				return nil, &base.HTTPError{http.StatusBadRequest, fmt.Sprintf("Attachment length mismatch for %q: read %d bytes, should be %g", name, len(data), length)}
+		for _, meta := range metas {
+			length, ok := meta["encoded_length"].(float64)
+			if !ok {
+				length, ok = meta["length"].(float64)
+			}
+			if ok {
+				if int(length) != len(data) {
+					return &base.HTTPError{http.StatusBadRequest, fmt.Sprintf("Attachment length mismatch for digest %q: read %d bytes, should be %g", digest, len(data), length)}
+				}
 			}
 		}
 
-		delete(meta, "follows")
-		meta["data"] = data
-		meta["digest"] = digest
+		value, err := gotData(data)
+		if err != nil {
+			return err
+		}
+		for _, meta := range metas {
+			delete(meta, "follows")
+			meta["data"] = value
+			meta["digest"] = digest
+		}
 	}
 
 	// Make sure there are no unused MIME parts:
-	_, err = reader.NextPart()
-	if err != io.EOF {
-		return nil, &base.HTTPError{http.StatusBadRequest, "Too many MIME parts"}
+	if _, err := reader.NextPart(); err != io.EOF {
+		return &base.HTTPError{http.StatusBadRequest, "Too many MIME parts"}
 	}
-
-	return body, nil
+	return nil
 }
 
 //////// HELPERS:
@@ -15,7 +15,6 @@ import (
 
 	"github.com/couchbaselabs/go-couchbase"
 
-	"github.com/couchbaselabs/sync_gateway/base"
 	"github.com/couchbaselabs/sync_gateway/channels"
 )
 
@@ -27,6 +26,7 @@ type ChangesOptions struct {
 	IncludeDocs    bool
 	includeDocMeta bool
 	Wait           bool
+	DocIDs         []string // If non-nil, only changes to these docs are returned
 }
 
 // A changes entry; Database.getChanges returns an array of these.
@@ -80,6 +80,14 @@ func (db *Database) ChangesFeed(channel string, options ChangesOptions) (<-chan
 		return feed, nil
 	}
 
+	var docIDs map[string]bool
+	if options.DocIDs != nil {
+		docIDs = make(map[string]bool, len(options.DocIDs))
+		for _, docID := range options.DocIDs {
+			docIDs[docID] = true
+		}
+	}
+
 	// Generate the output in a new goroutine, writing to 'feed':
 	go func() {
 		defer close(feed)
@@ -87,8 +95,8 @@ func (db *Database) ChangesFeed(channel string, options ChangesOptions) (<-chan
 			// Query the 'channels' view:
 			opts["startkey"] = []interface{}{channel, lastSequence + 1}
 			limit := totalLimit
-			if limit == 0 || limit > kChangesPageSize {
-				limit = kChangesPageSize
+			if limit == 0 || limit > kChangesPageSize || docIDs != nil {
+				limit = kChangesPageSize // when filtering, the limit can't be applied to the view
 			}
 			opts["limit"] = limit
 
@@ -97,8 +105,9 @@ func (db *Database) ChangesFeed(channel string, options ChangesOptions) (<-chan
 			for len(vres.Rows) == 0 {
 				vres = ViewResult{}
 				err = db.Bucket.ViewCustom("sync_gateway", "channels", opts, &vres)
+				db.Stats.ChangesQueries.Add(1)
 				if err != nil {
-					base.Log("Error from 'channels' view: %v", err)
+					db.logCtx.Log("Error from 'channels' view: %v", err)
 					return
 				}
 				if len(vres.Rows) == 0 {
@@ -108,11 +117,15 @@ func (db *Database) ChangesFeed(channel string, options ChangesOptions) (<-chan
 				}
 			}
 
+			sentAny := false
 			for _, row := range vres.Rows {
 				key := row.Key.([]interface{})
 				lastSequence = uint64(key[1].(float64))
 				value := row.Value.([]interface{})
 				docID := value[0].(string)
+				if docIDs != nil && !docIDs[docID] {
+					continue
+				}
 				revID := value[1].(string)
 				entry := &ChangeEntry{
 					Seq:     lastSequence,
@@ -142,18 +155,24 @@ func (db *Database) ChangesFeed(channel string, options ChangesOptions) (<-chan
 					}
 				}
 				feed <- entry
+				sentAny = true
+				if totalLimit > 0 {
+					totalLimit--
+					if totalLimit == 0 {
+						return
+					}
+				}
 			}
 
 			// Step to the next page of results:
-			nRows := len(vres.Rows)
-			if nRows < kChangesPageSize || options.Wait {
-				break
-			}
-			if totalLimit > 0 {
-				totalLimit -= nRows
-				if totalLimit <= 0 {
+			if options.Wait {
+				if sentAny {
 					break
 				}
+				continue // nothing passed the filter, so wait for more changes
+			}
+			if len(vres.Rows) < limit {
+				break
 			}
 			delete(opts, "stale") // we only need to update the index once
 		}
@@ -263,9 +282,9 @@ func (db *Database) GetChanges(channels channels.Set, options ChangesOptions) ([
 }
 
 func (db *Database) WaitForRevision() bool {
-	base.Log("\twaiting for a revision...")
+	db.logCtx.Log("\twaiting for a revision...")
 	waitFor("")
-	base.Log("\t...done waiting")
+	db.logCtx.Log("\t...done waiting")
 	return true
 }
 
@@ -0,0 +1,137 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// The progress of a database compaction, as reported by the admin API.
+type CompactionStatus struct {
+	Running       bool   `json:"running"`
+	DocsProcessed int    `json:"docs_processed"`
+	DocsCompacted int    `json:"docs_compacted"`
+	RevsCompacted int    `json:"revs_compacted"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Keeps track of the current (or last) compaction of a database. Thread-safe.
+type compactionTracker struct {
+	mutex  sync.Mutex
+	status CompactionStatus
+}
+
+// Marks a compaction as started, unless one is already running.
+func (c *compactionTracker) start() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.status.Running {
+		return false
+	}
+	c.status = CompactionStatus{Running: true}
+	return true
+}
+
+func (c *compactionTracker) processedDoc(revsCompacted int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.DocsProcessed++
+	if revsCompacted > 0 {
+		c.status.DocsCompacted++
+		c.status.RevsCompacted += revsCompacted
+	}
+}
+
+func (c *compactionTracker) finish(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.Running = false
+	if err != nil {
+		c.status.Error = err.Error()
+	}
+}
+
+// Returns the status of the database's current or most recent compaction.
+func (context *DatabaseContext) CompactionStatus() CompactionStatus {
+	context.compaction.mutex.Lock()
+	defer context.compaction.mutex.Unlock()
+	return context.compaction.status
+}
+
+// Starts compacting the database as a background task; use CompactionStatus to check its
+// progress.
+func (db *Database) StartCompaction() (*Task, error) {
+	if !db.compaction.start() {
+		return nil, &base.HTTPError{http.StatusConflict, "Compaction is already running"}
+	}
+	task, err := db.StartTask("database_compaction", db.Name, db.compact)
+	if err != nil {
+		db.compaction.finish(err)
+	}
+	return task, err
+}
+
+// Compacts the database, returning when it's finished.
+func (db *Database) Compact() (CompactionStatus, error) {
+	task, err := db.StartCompaction()
+	if err == nil {
+		err = task.Wait()
+	}
+	return db.CompactionStatus(), err
+}
+
+// Removes obsolete revision bodies from every document (see RevTree.compact).
+func (db *Database) compact(task *Task) (err error) {
+	db.logCtx.Log("Compacting database %q ...", db.Name)
+	defer func() {
+		db.compaction.finish(err)
+		db.logCtx.Log("Finished compacting database %q: %+v", db.Name, db.CompactionStatus())
+	}()
+
+	// The changes view includes deleted documents, unlike all_docs:
+	vres, err := db.Bucket.View("sync_gateway", "changes", Body{"stale": false})
+	if err != nil {
+		return err
+	}
+	for i, row := range vres.Rows {
+		if task.Canceled() {
+			return errTaskCanceled
+		}
+		docid := row.Value.([]interface{})[0].(string)
+		revsCompacted := 0
+		err = db.updateDocKeepingExpiry(docid, func(doc *document) ([]byte, error) {
+			if doc == nil {
+				return nil, couchbase.UpdateCancel // someone deleted it?!
+			}
+			if revsCompacted = doc.History.compact(); revsCompacted == 0 {
+				return nil, couchbase.UpdateCancel
+			}
+			return json.Marshal(doc)
+		})
+		if err == couchbase.UpdateCancel {
+			revsCompacted = 0
+		} else if err != nil {
+			db.logCtx.Warn("Error compacting doc %q: %v", docid, err)
+			return err
+		}
+		if revsCompacted > 0 {
+			db.logCtx.LogTo("CRUD", "\tCompacted %d revisions of doc %q", revsCompacted, docid)
+		}
+		db.compaction.processedDoc(revsCompacted)
+		task.SetProgress(i+1, len(vres.Rows))
+	}
+	return nil
+}
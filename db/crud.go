@@ -16,6 +16,7 @@ import (
 	"net/http"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/couchbaselabs/go-couchbase"
 
@@ -81,6 +82,18 @@ func (db *Database) GetRev(docid, revid string,
 	return body, nil
 }
 
+// Returns the IDs of a document's leaf revisions: the current revision plus any conflicts.
+func (db *Database) GetLeafRevIDs(docid string) ([]string, error) {
+	doc, err := db.getDoc(docid)
+	if doc == nil {
+		return nil, err
+	}
+	if err := AuthorizeAnyDocChannels(db.user, doc.Channels); err != nil {
+		return nil, err
+	}
+	return doc.History.getLeaves(), nil
+}
+
 // Returns an HTTP 403 error if the User is not allowed to access any of the document's channels.
 // A nil User means access control is disabled, so the function will return nil.
 func AuthorizeAnyDocChannels(user auth.User, channels ChannelMap) error {
@@ -111,6 +124,9 @@ func (db *Database) getRevFromDoc(doc *document, revid string, listRevisions boo
 			return nil, &base.HTTPError{Status: 404, Message: "deleted"}
 		}
 	}
+	if doc.isExpired() {
+		return nil, &base.HTTPError{Status: 404, Message: "expired"}
+	}
 	body := doc.getRevision(revid)
 	if body == nil {
 		return nil, &base.HTTPError{Status: 404, Message: "missing"}
@@ -126,11 +142,14 @@ func (db *Database) getRevFromDoc(doc *document, revid string, listRevisions boo
 }
 
 // Returns the body of the asked-for revision or the most recent available ancestor.
+// (If that revision has been compacted, the body contains only its "_attachments".)
 // Does NOT fill in _id, _rev, etc.
 func (db *Database) getAvailableRev(doc *document, revid string) (Body, error) {
 	for ; revid != ""; revid = doc.History[revid].Parent {
 		if body := doc.getRevision(revid); body != nil {
 			return body, nil
+		} else if doc.History[revid].Compacted {
+			return doc.History.getParsedRevisionBody(revid), nil
 		}
 	}
 	return nil, &base.HTTPError{404, "missing"}
@@ -138,19 +157,35 @@ func (db *Database) getAvailableRev(doc *document, revid string) (Body, error) {
 
 //////// UPDATING DOCUMENTS:
 
+// A callback that makes changes to a document and returns the body of the new revision.
+type updateFunc func(doc *document) (Body, error)
+
 // Updates or creates a document.
 // The new body's "_rev" property must match the current revision's, if any.
 func (db *Database) Put(docid string, body Body) (string, error) {
+	expiry, err := parseExpiry(body["_exp"])
+	if err != nil {
+		return "", err
+	}
+	callback, err := db.putCallback(body)
+	if err != nil {
+		return "", err
+	}
+	return db.updateDoc(docid, expiry, callback)
+}
+
+// Returns the updateDoc callback that implements Put.
+func (db *Database) putCallback(body Body) (updateFunc, error) {
 	// Get the revision ID to match, and the new generation number:
 	matchRev, _ := body["_rev"].(string)
 	generation, _ := parseRevID(matchRev)
 	if generation < 0 {
-		return "", &base.HTTPError{Status: http.StatusBadRequest, Message: "Invalid revision ID"}
+		return nil, &base.HTTPError{Status: http.StatusBadRequest, Message: "Invalid revision ID"}
 	}
 	generation++
 	deleted, _ := body["_deleted"].(bool)
 
-	return db.updateDoc(docid, func(doc *document) (Body, error) {
+	return func(doc *document) (Body, error) {
 		// Be careful: this block can be invoked multiple times if there are races!
 		// First, make sure matchRev matches an existing leaf revision:
 		if matchRev == "" {
@@ -180,19 +215,33 @@ func (db *Database) Put(docid string, body Body) (string, error) {
 		body["_rev"] = newRev
 		doc.History.addRevision(RevInfo{ID: newRev, Parent: matchRev, Deleted: deleted})
 		return body, nil
-	})
+	}, nil
 }
 
 // Adds an existing revision to a document along with its history (list of rev IDs.)
 // This is equivalent to the "new_edits":false mode of CouchDB.
 func (db *Database) PutExistingRev(docid string, body Body, docHistory []string) error {
+	expiry, err := parseExpiry(body["_exp"])
+	if err != nil {
+		return err
+	}
+	callback, err := db.putExistingRevCallback(body, docHistory)
+	if err != nil {
+		return err
+	}
+	_, err = db.updateDoc(docid, expiry, callback)
+	return err
+}
+
+// Returns the updateDoc callback that implements PutExistingRev.
+func (db *Database) putExistingRevCallback(body Body, docHistory []string) (updateFunc, error) {
 	newRev := docHistory[0]
 	generation, _ := parseRevID(newRev)
 	if generation < 0 {
-		return &base.HTTPError{Status: http.StatusBadRequest, Message: "Invalid revision ID"}
+		return nil, &base.HTTPError{Status: http.StatusBadRequest, Message: "Invalid revision ID"}
 	}
 	deleted, _ := body["_deleted"].(bool)
-	_, err := db.updateDoc(docid, func(doc *document) (Body, error) {
+	return func(doc *document) (Body, error) {
 		// Be careful: this block can be invoked multiple times if there are races!
 		// Find the point where this doc's history branches from the current rev:
 		currentRevIndex := len(docHistory)
@@ -224,86 +273,288 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 		}
 		body["_rev"] = newRev
 		return body, nil
-	})
-	return err
+	}, nil
+}
+
+// Describes a document update made by UpdateAllOrNothing, so it can be rolled back.
+type docUndo struct {
+	docID    string
+	revID    string // The revision the update added
+	sequence uint64 // The sequence the update assigned the document
+	oldValue []byte // nil if the document didn't exist
 }
 
 // Common subroutine of Put and PutExistingRev: a shell that loads the document, lets the caller
 // make changes to it in a callback and supply a new body, then saves the body and document.
-func (db *Database) updateDoc(docid string, callback func(*document) (Body, error)) (string, error) {
+// 'expiry' is the Unix time at which the document expires, or 0 if it doesn't.
+func (db *Database) updateDoc(docid string, expiry uint32, callback updateFunc) (string, error) {
+	return db.updateDocWithUndo(docid, expiry, callback, nil)
+}
+
+// Same as updateDoc, but if 'undo' is non-nil, stores what's needed to roll the update back in it.
+// In that case waiting _changes feeds aren't notified; the caller has to call NotifyRevision.
+func (db *Database) updateDocWithUndo(docid string, expiry uint32, callback updateFunc, undo *docUndo) (string, error) {
 	key := db.realDocID(docid)
 	if key == "" {
 		return "", &base.HTTPError{Status: 400, Message: "Invalid doc ID"}
 	}
 	var newRevID string
-	var body Body
+	defer db.Stats.DocWriteTime.ObserveSince(time.Now())
 
-	err := db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, error) {
+	attempts := 0
+	err := db.Bucket.Update(key, bucketExpiry(expiry), func(currentValue []byte) ([]byte, error) {
 		// Be careful: this block can be invoked multiple times if there are races!
+		if attempts++; attempts > 1 {
+			db.Stats.CASRetries.Add(1)
+		}
 		doc, err := unmarshalDocument(docid, currentValue)
 		if err != nil {
 			return nil, err
 		}
-
-		// Invoke the callback to update the document and return a new revision body:
-		body, err = callback(doc)
-		if err != nil {
+		if newRevID, err = db.applyUpdate(doc, callback, true); err != nil {
 			return nil, err
 		}
+		doc.Expiry = expiry
 
-		// Determine which is the current "winning" revision (it's not necessarily the new one):
-		newRevID = body["_rev"].(string)
-		prevCurrentRev := doc.CurrentRev
-		doc.CurrentRev = doc.History.winningRevision()
-		doc.Deleted = doc.History[doc.CurrentRev].Deleted
-
-		if doc.CurrentRev != prevCurrentRev && prevCurrentRev != "" {
-			// Store the doc's previous body into the revision tree:
-			bodyJSON, _ := json.Marshal(doc.body)
-			doc.History.setRevisionBody(prevCurrentRev, bodyJSON)
+		if undo != nil {
+			*undo = docUndo{docID: docid, sequence: doc.Sequence, oldValue: currentValue}
 		}
 
-		// Store the new revision body into the doc:
-		doc.setRevision(newRevID, body)
+		// Tell Couchbase to store the document:
+		return json.Marshal(doc)
+	})
 
-		if doc.CurrentRev != newRevID && doc.CurrentRev != prevCurrentRev {
-			// If the new revision is not current, transfer the current revision's
-			// body to the top level doc.body:
-			doc.body = doc.History.getParsedRevisionBody(doc.CurrentRev)
-			doc.History.setRevisionBody(doc.CurrentRev, nil)
+	if err == couchbase.UpdateCancel {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if newRevID != "" {
+		db.logCtx.LogTo("CRUD", "\tAdded doc %q / %q", docid, newRevID)
+		db.Stats.DocWrites.Add(1)
+		if undo != nil {
+			undo.revID = newRevID
 		}
+	}
 
+	if undo == nil {
+		db.NotifyRevision()
+	}
+	return newRevID, nil
+}
+
+// The core of updateDoc: invokes the callback to update the document in memory, then runs the
+// validation and sync functions. If 'save' is false, the document isn't assigned a sequence and
+// its channels and access aren't updated, so it shouldn't be saved afterwards.
+func (db *Database) applyUpdate(doc *document, callback updateFunc, save bool) (string, error) {
+	// Invoke the callback to update the document and return a new revision body:
+	body, err := callback(doc)
+	if err != nil {
+		return "", err
+	}
+
+	// Determine which is the current "winning" revision (it's not necessarily the new one):
+	newRevID := body["_rev"].(string)
+	prevCurrentRev := doc.CurrentRev
+	doc.CurrentRev = doc.History.winningRevision()
+	doc.Deleted = doc.History[doc.CurrentRev].Deleted
+
+	if doc.CurrentRev != prevCurrentRev && prevCurrentRev != "" {
+		// Store the doc's previous body into the revision tree:
+		bodyJSON, _ := json.Marshal(doc.body)
+		doc.History.setRevisionBody(prevCurrentRev, bodyJSON)
+	}
+
+	// Store the new revision body into the doc:
+	doc.setRevision(newRevID, body)
+
+	if doc.CurrentRev != newRevID && doc.CurrentRev != prevCurrentRev {
+		// If the new revision is not current, transfer the current revision's
+		// body to the top level doc.body:
+		doc.body = doc.History.getParsedRevisionBody(doc.CurrentRev)
+		doc.History.setRevisionBody(doc.CurrentRev, nil)
+	}
+
+	if save {
 		// Assign the document the next sequence number, for the _changes feed:
 		doc.Sequence, err = db.sequences.nextSequence()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
+	}
 
-		// Run the validation and sync functions
-		parentRevID := doc.History[newRevID].Parent
-		body["_id"] = doc.ID
-		channels, access, err := db.getChannelsAndAccess(doc, body, parentRevID)
+	// Run the validation and sync functions
+	parentRevID := doc.History[newRevID].Parent
+	body["_id"] = doc.ID
+	channels, access, err := db.getChannelsAndAccess(doc, body, parentRevID)
+	if err != nil {
+		return "", err
+	}
+	if save {
+		db.updateDocChannels(doc, channels) //FIX: Incorrect if new rev is not current!
+		db.updateDocAccess(doc, access)
+
+		// Keep the revision tree from growing without bound:
+		if pruned := doc.History.pruneRevisions(db.RevsLimit()); pruned > 0 {
+			db.logCtx.LogTo("CRUD", "\tPruned %d old revisions of doc %q", pruned, doc.ID)
+		}
+	}
+	return newRevID, nil
+}
+
+//////// ALL-OR-NOTHING UPDATES:
+
+// One document update in a call to UpdateAllOrNothing.
+type DocUpdate struct {
+	DocID   string   // If empty, a random doc ID will be assigned
+	Body    Body     // The new revision's body
+	History []string // If non-nil, the revision is added as by PutExistingRev instead of Put
+}
+
+// Returns a new updateDoc callback that applies the update.
+func (db *Database) updateCallback(update *DocUpdate, body Body) (updateFunc, error) {
+	if update.History != nil {
+		return db.putExistingRevCallback(body, update.History)
+	}
+	return db.putCallback(body)
+}
+
+// Applies a set of document updates, such that either all of them are saved or none are.
+// First every update is checked, including by the validation and sync functions, without saving
+// anything (not even attachments.) Then the documents are saved; if any save fails, the ones
+// already saved are rolled back to their previous state. _changes feeds aren't notified until
+// the batch is finished. Returns the new revision IDs; also fills in missing DocIDs.
+func (db *Database) UpdateAllOrNothing(updates []DocUpdate) ([]string, error) {
+	// The validation and sync functions only see a doc and its parent, so updates of different
+	// docs can't affect each other's checks. But a doc can't be updated twice, since the second
+	// update would have to be checked against the first one, which hasn't been saved.
+	docIDs := map[string]bool{}
+	attachments := map[AttachmentKey][]byte{}
+	for i := range updates {
+		update := &updates[i]
+		if update.DocID == "" {
+			if update.History != nil || update.Body["_rev"] != nil {
+				return nil, &base.HTTPError{Status: http.StatusNotFound,
+					Message: "No previous revision to replace"}
+			}
+			update.DocID = createUUID()
+		} else if docIDs[update.DocID] {
+			return nil, &base.HTTPError{Status: http.StatusBadRequest,
+				Message: fmt.Sprintf("Doc %q is updated more than once", update.DocID)}
+		}
+		docIDs[update.DocID] = true
+
+		// Check the update against a copy of the body, since updating alters the body:
+		_, err := parseExpiry(update.Body["_exp"])
+		if err == nil {
+			err = prepareAttachments(update.Body, attachments)
+		}
+		var callback updateFunc
+		if err == nil {
+			callback, err = db.updateCallback(update, copyBody(update.Body))
+		}
+		if err == nil {
+			err = db.checkUpdate(update.DocID, callback)
+		}
 		if err != nil {
+			db.logCtx.Log("UpdateAllOrNothing: Doc %q would fail: %v", update.DocID, err)
 			return nil, err
 		}
-		db.updateDocChannels(doc, channels) //FIX: Incorrect if new rev is not current!
-		db.updateDocAccess(doc, access)
+	}
 
-		// Tell Couchbase to store the document:
-		return json.Marshal(doc)
-	})
+	defer db.NotifyRevision()
+	for key, data := range attachments {
+		if _, err := db.setAttachment(data); err != nil {
+			db.logCtx.Warn("UpdateAllOrNothing: Couldn't save attachment %q: %v", key, err)
+			return nil, err
+		}
+	}
+	revIDs := make([]string, len(updates))
+	undos := make([]docUndo, 0, len(updates))
+	for i := range updates {
+		update := &updates[i]
+		expiry, _ := parseExpiry(update.Body["_exp"]) // already checked above
+		callback, err := db.updateCallback(update, update.Body)
+		var undo docUndo
+		if err == nil {
+			revIDs[i], err = db.updateDocWithUndo(update.DocID, expiry, callback, &undo)
+		}
+		if err != nil {
+			db.logCtx.Warn("UpdateAllOrNothing: Doc %q failed (%v); rolling back %d docs",
+				update.DocID, err, len(undos))
+			for j := len(undos) - 1; j >= 0; j-- {
+				if rollbackErr := db.rollBack(undos[j]); rollbackErr != nil {
+					db.logCtx.Warn("UpdateAllOrNothing: Couldn't roll back doc %q: %v",
+						undos[j].docID, rollbackErr)
+					err = &base.HTTPError{http.StatusInternalServerError,
+						fmt.Sprintf("Update failed, and couldn't be rolled back (doc %q)", undos[j].docID)}
+				}
+			}
+			return nil, err
+		}
+		if undo.revID != "" {
+			undos = append(undos, undo)
+		}
+	}
+	return revIDs, nil
+}
 
-	if err == couchbase.UpdateCancel {
-		return "", nil
-	} else if err != nil {
-		return "", err
+// Runs an update callback and the validation and sync functions on a document without saving it.
+func (db *Database) checkUpdate(docid string, callback updateFunc) error {
+	key := db.realDocID(docid)
+	if key == "" {
+		return &base.HTTPError{Status: 400, Message: "Invalid doc ID"}
 	}
-	if newRevID != "" {
-		base.LogTo("CRUD", "\tAdded doc %q / %q", docid, newRevID)
+	currentValue, err := db.Bucket.GetRaw(key)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return err
 	}
+	doc, err := unmarshalDocument(docid, currentValue)
+	if err != nil {
+		return err
+	}
+	_, err = db.applyUpdate(doc, callback, false)
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return err
+}
 
-	db.NotifyRevision()
-	return newRevID, nil
+// Undoes an update saved by UpdateAllOrNothing, by putting back the document's previous value
+// (or deleting it, if it didn't exist.) The validation and sync functions aren't run, since this
+// restores a state they've already accepted. The restored document gets a new sequence, so that
+// a _changes feed that saw the update will see the document again. Fails if the document's been
+// changed again since the update.
+func (db *Database) rollBack(undo docUndo) error {
+	db.logCtx.LogTo("CRUD", "\tRolling back doc %q / %q", undo.docID, undo.revID)
+	var oldDoc *document
+	var expiry uint32
+	if undo.oldValue != nil {
+		var err error
+		if oldDoc, err = unmarshalDocument(undo.docID, undo.oldValue); err != nil {
+			return err
+		}
+		expiry = oldDoc.Expiry
+	}
+	return db.Bucket.Update(db.realDocID(undo.docID), bucketExpiry(expiry), func(currentValue []byte) ([]byte, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		doc, err := unmarshalDocument(undo.docID, currentValue)
+		if err != nil {
+			return nil, err
+		} else if doc.Sequence != undo.sequence {
+			return nil, &base.HTTPError{Status: http.StatusConflict, Message: "Document changed"}
+		}
+		if oldDoc == nil {
+			db.updateDocAccess(doc, nil)
+			return nil, nil // deletes the document
+		}
+		db.updateDocAccess(doc, oldDoc.Access)
+		restored := *oldDoc
+		if restored.Sequence, err = db.sequences.nextSequence(); err != nil {
+			return nil, err
+		}
+		return json.Marshal(&restored)
+	})
 }
 
 // Creates a new document, assigning it a random doc ID.
@@ -320,6 +571,37 @@ func (db *Database) Post(body Body) (string, string, error) {
 	return docid, rev, err
 }
 
+// Copies a revision of a document (the current one if srcRevID is empty) to a new document, or
+// to a new revision of an existing one whose current revision is dstRevID. Returns the new rev ID.
+func (db *Database) CopyDoc(srcDocID, srcRevID, dstDocID, dstRevID string) (string, error) {
+	body, err := db.GetRev(srcDocID, srcRevID, false, nil)
+	if err != nil {
+		return "", err
+	}
+	body = restorableBody(body)
+	if dstRevID != "" {
+		body["_rev"] = dstRevID
+	} else {
+		delete(body, "_rev")
+	}
+	return db.Put(dstDocID, body)
+}
+
+// Copies a revision body so it can be saved as a new revision, with its attachments pointing to
+// their already-saved data (the new revision's parent may not have them.) Attachments are
+// stored by digest, so the copy can just point to the same data.
+func restorableBody(body Body) Body {
+	body = copyBody(body)
+	delete(body, "_id")
+	for _, value := range BodyAttachments(body) {
+		meta := value.(map[string]interface{})
+		digest, _ := meta["digest"].(string)
+		length, _ := meta["length"].(float64)
+		meta["data"] = savedAttachment{key: AttachmentKey(digest), length: int(length)}
+	}
+	return body
+}
+
 // Deletes a document, by adding a new revision whose "_deleted" property is true.
 func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 	body := Body{"_deleted": true, "_rev": revid}
@@ -331,24 +613,30 @@ func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 // Calls the JS ChannelMapper and Validation functions to assign the doc to channels, grant users
 // access to channels, and reject invalid documents.
 func (db *Database) getChannelsAndAccess(doc *document, body Body, parentRevID string) (result channels.Set, access channels.AccessMap, err error) {
-	base.LogTo("CRUD", "Invoking validate/sync on doc %q rev %s", doc.ID, body["_rev"])
+	db.logCtx.LogTo("CRUD", "Invoking validate/sync on doc %q rev %s", doc.ID, body["_rev"])
 	newJson, _ := json.Marshal(body)
 	var oldJson []byte
 	if parentRevID != "" {
-		oldJson = doc.getRevisionJSON(parentRevID)
+		// If the parent's body is gone (it was compacted) the functions get an oldDoc of null,
+		// whereas for a new document it's undefined.
+		if oldJson = doc.getRevisionJSON(parentRevID); oldJson == nil {
+			oldJson = []byte("null")
+		}
 	}
 
 	if db.Validator != nil {
 		var status int
 		var msg string
+		start := time.Now()
 		status, msg, err = db.Validator.Validate(string(newJson), string(oldJson), db.user)
+		db.Stats.ValidatorTime.ObserveSince(start)
 		if err != nil {
-			base.Warn("Validator exception: %v; doc = %s", err, newJson)
+			db.logCtx.Warn("Validator exception: %v; doc = %s", err, newJson)
 			status = http.StatusInternalServerError
 			msg = "Exception in JS validation function"
 		}
 		if status >= 300 {
-			base.Log("Validator rejected: new=%s  old=%s --> %d %q", newJson, oldJson, status, msg)
+			db.logCtx.Log("Validator rejected: new=%s  old=%s --> %d %q", newJson, oldJson, status, msg)
 			err = &base.HTTPError{status, msg}
 			return
 		}
@@ -356,20 +644,22 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, parentRevID s
 
 	if db.ChannelMapper != nil {
 		var output *channels.ChannelMapperOutput
+		start := time.Now()
 		output, err = db.ChannelMapper.MapToChannelsAndAccess(string(newJson), string(oldJson),
 			makeUserCtx(db.user))
+		db.Stats.SyncFunctionTime.ObserveSince(start)
 		if err == nil {
 			result = output.Channels
 			access = output.Access
 			err = output.Rejection
 			if err != nil {
-				base.Log("Sync fn rejected: new=%s  old=%s --> %s", newJson, oldJson, err)
+				db.logCtx.Log("Sync fn rejected: new=%s  old=%s --> %s", newJson, oldJson, err)
 			} else if !validateAccessMap(access) {
 				err = &base.HTTPError{500, fmt.Sprintf("Error in JS sync function")}
 			}
 
 		} else {
-			base.Warn("Sync fn exception: %v; doc = %s", err, newJson)
+			db.logCtx.Warn("Sync fn exception: %v; doc = %s", err, newJson)
 			err = &base.HTTPError{500, "Exception in JS sync function"}
 		}
 
@@ -415,7 +705,7 @@ func (db *Database) updateDocChannels(doc *document, newChannels channels.Set) (
 		}
 	}
 	if changed {
-		base.LogTo("CRUD", "\tDoc %q in channels %q", doc.ID, newChannels)
+		db.logCtx.LogTo("CRUD", "\tDoc %q in channels %q", doc.ID, newChannels)
 	}
 	return changed
 }
@@ -442,9 +732,9 @@ func (db *Database) updateDocAccess(doc *document, newAccess channels.AccessMap)
 	}
 
 	doc.Access = newAccess
-	base.LogTo("CRUD", "\tDoc %q grants access: %+v", doc.ID, newAccess)
+	db.logCtx.LogTo("CRUD", "\tDoc %q grants access: %+v", doc.ID, newAccess)
 
-	authr := auth.NewAuthenticator(db.Bucket, nil)
+	authr := auth.NewAuthenticator(db.Bucket, nil).WithLogContext(db.logCtx)
 	for name, _ := range oldAccess {
 		if user, _ := authr.GetUser(name); user != nil {
 			authr.InvalidateChannels(user)
@@ -513,7 +803,7 @@ func (db *Database) RevDiff(docid string, revids []string) (missing, possible []
 	doc, err := db.getDoc(docid)
 	if err != nil {
 		if !isMissingDocError(err) {
-			base.Warn("RevDiff(%q) --> %T %v", docid, err, err)
+			db.logCtx.Warn("RevDiff(%q) --> %T %v", docid, err, err)
 			// If something goes wrong getting the doc, treat it as though it's nonexistent.
 		}
 		missing = revids
@@ -13,6 +13,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"regexp"
+	"sync"
+	"sync/atomic"
 
 	"github.com/couchbaselabs/go-couchbase"
 	"github.com/couchbaselabs/walrus"
@@ -32,13 +34,23 @@ type DatabaseContext struct {
 	sequences     *sequenceAllocator
 	ChannelMapper *channels.ChannelMapper
 	Validator     *Validator
+	revsLimit     uint32 // Max depth a document's revision tree can grow to (access atomically)
+	compaction    compactionTracker
+	stopExpiry    chan bool        // Closing this stops the goroutine started by StartExpiry
+	tasks         map[string]*Task // Running background tasks, by ID
+	tasksLock     sync.Mutex
+	Stats         *DatabaseStats // Runtime statistics
 }
 
+// Default value of DatabaseContext.RevsLimit()
+const DefaultRevsLimit = 1000
+
 // Represents a simulated CouchDB database. A new instance is created for each HTTP request,
 // so this struct does not have to be thread-safe.
 type Database struct {
 	*DatabaseContext
-	user auth.User
+	user   auth.User
+	logCtx *base.LogContext // Tags log messages with the request, database and user
 }
 
 // Helper function to open a Couchbase connection and return a specific bucket.
@@ -57,30 +69,47 @@ func NewDatabaseContext(dbName string, bucket base.Bucket) (*DatabaseContext, er
 	if err != nil {
 		return nil, err
 	}
-	return &DatabaseContext{Name: dbName, Bucket: bucket, sequences: sequences}, nil
+	stats := newDatabaseStats()
+	return &DatabaseContext{Name: dbName, Bucket: &timedBucket{bucket, stats.BucketOpTime},
+		sequences: sequences, revsLimit: DefaultRevsLimit, Stats: stats}, nil
+}
+
+// The maximum depth a document's revision tree can grow to.
+func (context *DatabaseContext) RevsLimit() uint32 {
+	return atomic.LoadUint32(&context.revsLimit)
+}
+
+func (context *DatabaseContext) SetRevsLimit(limit uint32) {
+	atomic.StoreUint32(&context.revsLimit, limit)
 }
 
 // Sets the database context's channelMapper and validator based on the JS code in _design/channels
 func (context *DatabaseContext) ReadDesignDocument() error {
-	db := &Database{context, nil}
-	var err error
+	_, err := context.readDesignDocument()
+	return err
+}
+
+// Like ReadDesignDocument, but also returns true if the sync function changed.
+func (context *DatabaseContext) readDesignDocument() (syncChanged bool, err error) {
+	db := &Database{context, nil, context.newLogContext(nil)}
 	body, err := db.GetSpecial("design", "channels")
 	if err != nil {
 		if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusNotFound {
 			err = nil // missing design document is not an error
 		}
-		return err
+		return false, err
 	}
 	if src, ok := body["sync"].(string); ok {
 		base.Log("Sync function = %s", src)
 		if context.ChannelMapper != nil {
-			_, err = context.ChannelMapper.SetFunction(src)
+			syncChanged, err = context.ChannelMapper.SetFunction(src)
 		} else {
 			context.ChannelMapper, err = channels.NewChannelMapper(src)
+			syncChanged = true
 		}
 		if err != nil {
 			base.Warn("Error loading channel mapper: %s", err)
-			return err
+			return false, err
 		}
 	}
 	if src, ok := body["validate_doc_update"].(string); ok {
@@ -92,19 +121,34 @@ func (context *DatabaseContext) ReadDesignDocument() error {
 		}
 		if err != nil {
 			base.Warn("Error loading validator: %s", err)
-			return err
+			return syncChanged, err
 		}
 	}
-	return nil
+	return syncChanged, nil
 }
 
 // Makes a Database object given its name and bucket.
 func GetDatabase(context *DatabaseContext, user auth.User) (*Database, error) {
-	return &Database{context, user}, nil
+	return &Database{context, user, context.newLogContext(user)}, nil
 }
 
 func CreateDatabase(context *DatabaseContext) (*Database, error) {
-	return &Database{context, nil}, nil
+	return &Database{context, nil, context.newLogContext(nil)}, nil
+}
+
+// The default LogContext of a Database, which identifies it and its user.
+func (context *DatabaseContext) newLogContext(user auth.User) *base.LogContext {
+	ctx := &base.LogContext{Database: context.Name}
+	if user != nil {
+		ctx.User = user.Name()
+	}
+	return ctx
+}
+
+// Sets the context that the database's log messages are tagged with, such as the ID of the
+// HTTP request it's handling.
+func (db *Database) SetLogContext(ctx *base.LogContext) {
+	db.logCtx = ctx
 }
 
 func (db *Database) SameAs(otherdb *Database) bool {
@@ -116,14 +160,11 @@ func (db *Database) SameAs(otherdb *Database) bool {
 
 // The number of documents in the database.
 func (db *Database) DocCount() int {
-	vres, err := db.queryAllDocs(true)
+	count, err := db.countAllDocs(Body{})
 	if err != nil {
 		return -1
 	}
-	if len(vres.Rows) == 0 {
-		return 0
-	}
-	return int(vres.Rows[0].Value.(float64))
+	return count
 }
 
 func installViews(bucket base.Bucket) error {
@@ -137,7 +178,32 @@ func installViews(bucket base.Bucket) error {
                        return;
                      if (sync.deleted)
                        return;
-                     emit(meta.id, sync.rev); }`
+                     var channels = [];
+                     var channelMap = sync.channels;
+                     if (channelMap) {
+                       for (var name in channelMap) {
+                         if (!channelMap[name])
+                           channels.push(name);
+                       }
+                     }
+                     emit(meta.id, [sync.rev, channels]); }`
+	// View for _all_docs as seen by a user who can only access some channels
+	channeldocs_map := `function (doc, meta) {
+                     var sync = doc._sync;
+                     if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+                       return;
+                     if (sync.deleted)
+                       return;
+                     var channels = [];
+                     var channelMap = sync.channels;
+                     if (channelMap) {
+                       for (var name in channelMap) {
+                         if (!channelMap[name])
+                           channels.push(name);
+                       }
+                     }
+                     for (var i = 0; i < channels.length; ++i)
+                       emit([channels[i], meta.id], [sync.rev, channels]); }`
 	// View for _changes feed, i.e. a by-sequence index
 	changes_map := `function (doc, meta) {
                     var sync = doc._sync;
@@ -172,6 +238,14 @@ func installViews(bucket base.Bucket) error {
 							}
 						}
 					}`
+	// View of expiring docs by expiry time, used by ExpireDocs()
+	expiry_map := `function (doc, meta) {
+	                    var sync = doc._sync;
+	                    if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+	                        return;
+	                    if (sync.exp && !sync.deleted)
+	                        emit(sync.exp, null);
+	               }`
 	// Channel access view, used by ComputeChannelsForPrincipal()
 	access_map := `function (doc, meta) {
 	                    var sync = doc._sync;
@@ -190,11 +264,13 @@ func installViews(bucket base.Bucket) error {
 
 	ddoc := walrus.DesignDoc{
 		Views: walrus.ViewMap{
-			"all_bits": walrus.ViewDef{Map: allbits_map},
-			"all_docs": walrus.ViewDef{Map: alldocs_map, Reduce: "_count"},
-			"channels": walrus.ViewDef{Map: channels_map},
-			"access":   walrus.ViewDef{Map: access_map},
-			"changes":  walrus.ViewDef{Map: changes_map},
+			"all_bits":     walrus.ViewDef{Map: allbits_map},
+			"all_docs":     walrus.ViewDef{Map: alldocs_map, Reduce: "_count"},
+			"channel_docs": walrus.ViewDef{Map: channeldocs_map, Reduce: "_count"},
+			"channels":     walrus.ViewDef{Map: channels_map},
+			"access":       walrus.ViewDef{Map: access_map},
+			"changes":      walrus.ViewDef{Map: changes_map},
+			"expiry":       walrus.ViewDef{Map: expiry_map},
 		},
 	}
 	err := bucket.PutDDoc("sync_gateway", ddoc)
@@ -205,50 +281,345 @@ func installViews(bucket base.Bucket) error {
 }
 
 type IDAndRev struct {
-	DocID string
-	RevID string
+	DocID    string
+	RevID    string
+	Channels []string // Only filled in if AllDocsOptions.IncludeChannels is set
+}
+
+// Options for QueryAllDocIDs, corresponding to the query parameters of _all_docs.
+type AllDocsOptions struct {
+	StartKey        string   // First doc ID to return (the highest one, if Descending)
+	EndKey          string   // Last doc ID to return (the lowest one, if Descending)
+	ExcludeEnd      bool     // If true, a doc whose ID equals EndKey is not returned
+	Limit           int      // Maximum number of IDs to return; 0 means no limit
+	Skip            int      // Number of IDs to skip before the first one returned
+	Descending      bool     // Return IDs in descending order?
+	Keys            []string // If non-nil, return only these doc IDs (ignoring the other options)
+	IncludeChannels bool     // Fill in the Channels of each IDAndRev?
+}
+
+// A page of document IDs returned by QueryAllDocIDs.
+type AllDocsResult struct {
+	TotalRows int        // Number of (non-deleted) documents visible to the user
+	Offset    int        // Position of the first row within the entire ordered list of docs
+	Rows      []IDAndRev // The document IDs and current revision IDs
 }
 
 // Returns all document IDs as an array.
 func (db *Database) AllDocIDs() ([]IDAndRev, error) {
-	vres, err := db.queryAllDocs(false)
+	result, err := db.QueryAllDocIDs(AllDocsOptions{})
 	if err != nil {
 		return nil, err
 	}
+	return result.Rows, nil
+}
 
-	rows := vres.Rows
-	result := make([]IDAndRev, 0, len(rows))
-	for _, row := range rows {
-		result = append(result, IDAndRev{DocID: row.Key.(string), RevID: row.Value.(string)})
+// Returns the document IDs (and current revision IDs) in the range given by the options.
+// If the database has a user, only documents in channels the user can access are returned.
+func (db *Database) QueryAllDocIDs(options AllDocsOptions) (*AllDocsResult, error) {
+	if db.user != nil {
+		if channels := db.user.Channels(); !channels.Contains("*") {
+			return db.queryChannelDocIDs(channels, options)
+		}
+	}
+
+	if options.Keys != nil {
+		vres, err := db.queryAllDocs(Body{"reduce": false, "keys": options.Keys})
+		if err != nil {
+			return nil, err
+		}
+		result := &AllDocsResult{Rows: make([]IDAndRev, 0, len(vres.Rows))}
+		for _, row := range vres.Rows {
+			result.Rows = append(result.Rows, makeIDAndRev(row.Key.(string), row.Value, options))
+		}
+		result.TotalRows, err = db.countAllDocs(Body{})
+		return result, err
+	}
+
+	opts := Body{"reduce": false}
+	if options.StartKey != "" {
+		opts["startkey"] = options.StartKey
+	}
+	if options.EndKey != "" {
+		opts["endkey"] = options.EndKey
+		opts["inclusive_end"] = !options.ExcludeEnd
+	}
+	if options.Limit > 0 {
+		opts["limit"] = options.Limit
+	}
+	if options.Skip > 0 {
+		opts["skip"] = options.Skip
+	}
+	if options.Descending {
+		opts["descending"] = true
+	}
+	vres, err := db.queryAllDocs(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AllDocsResult{Rows: make([]IDAndRev, 0, len(vres.Rows))}
+	for _, row := range vres.Rows {
+		result.Rows = append(result.Rows, makeIDAndRev(row.Key.(string), row.Value, options))
+	}
+
+	// The view doesn't report the total or the offset, so count them using the reduce function:
+	if result.TotalRows, err = db.countAllDocs(Body{}); err != nil {
+		return nil, err
+	}
+	if options.StartKey != "" {
+		// The offset is the number of docs that sort before StartKey:
+		countOpts := Body{"endkey": options.StartKey, "inclusive_end": false}
+		if options.Descending {
+			countOpts["descending"] = true
+		}
+		if result.Offset, err = db.countAllDocs(countOpts); err != nil {
+			return nil, err
+		}
+	}
+	result.Offset += options.Skip
+	if result.Offset > result.TotalRows {
+		result.Offset = result.TotalRows
 	}
 	return result, nil
 }
 
-func (db *Database) queryAllDocs(reduce bool) (walrus.ViewResult, error) {
-	opts := Body{"stale": false, "reduce": reduce}
+// Implementation of QueryAllDocIDs for a user who can't see every channel. Queries the
+// channel_docs view over the requested range of each of the user's channels, then merges the
+// sorted results, skipping docs that are in more than one of the channels.
+func (db *Database) queryChannelDocIDs(userChannels channels.Set, options AllDocsOptions) (*AllDocsResult, error) {
+	result := &AllDocsResult{Rows: make([]IDAndRev, 0)}
+	streams := make([][]walrus.ViewRow, 0, len(userChannels))
+	for channel, _ := range userChannels {
+		vres, err := db.queryChannelDocs(channelDocsOptions(channel, options))
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, vres.Rows)
+	}
+	var err error
+	if result.TotalRows, result.Offset, err = db.countVisibleDocs(userChannels, options); err != nil {
+		return nil, err
+	}
+
+	if options.Keys != nil {
+		docs := map[string]IDAndRev{}
+		for _, rows := range streams {
+			for _, row := range rows {
+				docid := row.Key.([]interface{})[1].(string)
+				docs[docid] = makeIDAndRev(docid, row.Value, options)
+			}
+		}
+		for _, docid := range options.Keys {
+			if id, found := docs[docid]; found {
+				result.Rows = append(result.Rows, id)
+			}
+		}
+		return result, nil
+	}
+
+	// Merge the channels' rows, applying the skip and limit:
+	before := func(a, b string) bool {
+		if options.Descending {
+			return a > b
+		}
+		return a < b
+	}
+	seen := map[string]bool{}
+	skip := options.Skip
+	for options.Limit == 0 || len(result.Rows) < options.Limit {
+		next, nextID := -1, ""
+		for i, rows := range streams {
+			if len(rows) > 0 {
+				docid := rows[0].Key.([]interface{})[1].(string)
+				if next < 0 || before(docid, nextID) {
+					next, nextID = i, docid
+				}
+			}
+		}
+		if next < 0 {
+			break
+		}
+		row := streams[next][0]
+		streams[next] = streams[next][1:]
+		if seen[nextID] {
+			continue
+		}
+		seen[nextID] = true
+		if skip > 0 {
+			skip--
+			continue
+		}
+		result.Rows = append(result.Rows, makeIDAndRev(nextID, row.Value, options))
+	}
+	result.Offset += options.Skip
+	if result.Offset > result.TotalRows {
+		result.Offset = result.TotalRows
+	}
+	return result, nil
+}
+
+// Returns the channel_docs view options to query a channel for the docs QueryAllDocIDs wants.
+func channelDocsOptions(channel string, options AllDocsOptions) Body {
+	if options.Keys != nil {
+		keys := make([]interface{}, len(options.Keys))
+		for i, docid := range options.Keys {
+			keys[i] = []interface{}{channel, docid}
+		}
+		return Body{"keys": keys}
+	}
+
+	first, last := []interface{}{channel}, []interface{}{channel, map[string]interface{}{}}
+	if options.Descending {
+		first, last = last, first
+	}
+	opts := Body{"startkey": first, "endkey": last, "descending": options.Descending}
+	if options.StartKey != "" {
+		opts["startkey"] = []interface{}{channel, options.StartKey}
+	}
+	if options.EndKey != "" {
+		opts["endkey"] = []interface{}{channel, options.EndKey}
+		opts["inclusive_end"] = !options.ExcludeEnd
+	}
+	if options.Limit > 0 {
+		// Each of the first Skip+Limit merged docs is within this channel's first Skip+Limit rows:
+		opts["limit"] = options.Skip + options.Limit
+	}
+	return opts
+}
+
+func (db *Database) queryChannelDocs(opts Body) (walrus.ViewResult, error) {
+	opts["stale"] = false
+	if _, found := opts["reduce"]; !found {
+		opts["reduce"] = false
+	}
+	vres, err := db.Bucket.View("sync_gateway", "channel_docs", opts)
+	if err != nil {
+		db.logCtx.Warn("channel_docs got error: %v", err)
+	}
+	return vres, err
+}
+
+// Returns the number of distinct docs in any of the channels, and how many of them sort before
+// options.StartKey. The view's counts are only enough for a single channel; with more, a doc can
+// be in several, so the channels' doc IDs (but not the docs) have to be read and deduplicated.
+func (db *Database) countVisibleDocs(userChannels channels.Set, options AllDocsOptions) (total, offset int, err error) {
+	countOffset := options.StartKey != "" && options.Keys == nil
+	if len(userChannels) == 1 {
+		for channel, _ := range userChannels {
+			total, err = db.countChannelDocs(Body{"startkey": []interface{}{channel},
+				"endkey": []interface{}{channel, map[string]interface{}{}}})
+			if err != nil || !countOffset {
+				return
+			}
+			countOpts := Body{"endkey": []interface{}{channel, options.StartKey},
+				"inclusive_end": false}
+			if options.Descending {
+				countOpts["startkey"] = []interface{}{channel, map[string]interface{}{}}
+				countOpts["descending"] = true
+			} else {
+				countOpts["startkey"] = []interface{}{channel}
+			}
+			offset, err = db.countChannelDocs(countOpts)
+		}
+		return
+	}
+
+	seen := map[string]bool{}
+	for channel, _ := range userChannels {
+		vres, err := db.queryChannelDocs(Body{"startkey": []interface{}{channel},
+			"endkey": []interface{}{channel, map[string]interface{}{}}})
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, row := range vres.Rows {
+			docid := row.Key.([]interface{})[1].(string)
+			if seen[docid] {
+				continue
+			}
+			seen[docid] = true
+			total++
+			if countOffset && ((!options.Descending && docid < options.StartKey) ||
+				(options.Descending && docid > options.StartKey)) {
+				offset++
+			}
+		}
+	}
+	return
+}
+
+// Returns the number of rows in the channel_docs view that match the given view options.
+func (db *Database) countChannelDocs(opts Body) (int, error) {
+	opts["reduce"] = true
+	vres, err := db.queryChannelDocs(opts)
+	if err != nil || len(vres.Rows) == 0 {
+		return 0, err
+	}
+	return int(vres.Rows[0].Value.(float64)), nil
+}
+
+// Creates an IDAndRev from the value of a row of the all_docs or channel_docs view.
+func makeIDAndRev(docid string, value interface{}, options AllDocsOptions) IDAndRev {
+	values := value.([]interface{})
+	id := IDAndRev{DocID: docid, RevID: values[0].(string)}
+	if options.IncludeChannels {
+		id.Channels = make([]string, 0)
+		if channels, ok := values[1].([]interface{}); ok {
+			for _, channel := range channels {
+				id.Channels = append(id.Channels, channel.(string))
+			}
+		}
+	}
+	return id
+}
+
+func (db *Database) queryAllDocs(opts Body) (walrus.ViewResult, error) {
+	opts["stale"] = false
 	vres, err := db.Bucket.View("sync_gateway", "all_docs", opts)
 	if err != nil {
-		base.Warn("all_docs got error: %v", err)
+		db.logCtx.Warn("all_docs got error: %v", err)
 	}
 	return vres, err
 }
 
-// Deletes a database (and all documents)
+// Returns the number of docs in the all_docs view that match the given view options.
+func (db *Database) countAllDocs(opts Body) (int, error) {
+	opts["reduce"] = true
+	vres, err := db.queryAllDocs(opts)
+	if err != nil || len(vres.Rows) == 0 {
+		return 0, err
+	}
+	return int(vres.Rows[0].Value.(float64)), nil
+}
+
+// Deletes a database (and all documents), as a background task; returns when it's finished.
 func (db *Database) Delete() error {
+	task, err := db.StartTask("database_deletion", db.Name, db.deleteAll)
+	if err != nil {
+		return err
+	}
+	return task.Wait()
+}
+
+func (db *Database) deleteAll(task *Task) error {
 	opts := Body{"stale": false}
 	vres, err := db.Bucket.View("sync_gateway", "all_bits", opts)
 	if err != nil {
-		base.Warn("all_bits view returned %v", err)
+		db.logCtx.Warn("all_bits view returned %v", err)
 		return err
 	}
 
 	//FIX: Is there a way to do this in one operation?
-	base.Log("Deleting %d documents of %q ...", len(vres.Rows), db.Name)
-	for _, row := range vres.Rows {
-		base.LogTo("CRUD", "\tDeleting %q", row.ID)
+	db.logCtx.Log("Deleting %d documents of %q ...", len(vres.Rows), db.Name)
+	for i, row := range vres.Rows {
+		if task.Canceled() {
+			return errTaskCanceled
+		}
+		db.logCtx.LogTo("CRUD", "\tDeleting %q", row.ID)
 		if err := db.Bucket.Delete(row.ID); err != nil {
-			base.Warn("Error deleting %q: %v", row.ID, err)
+			db.logCtx.Warn("Error deleting %q: %v", row.ID, err)
 		}
+		task.SetProgress(i+1, len(vres.Rows))
 	}
 	return nil
 }
@@ -258,26 +629,36 @@ func VacuumAttachments(bucket base.Bucket) (int, error) {
 	return 0, &base.HTTPError{http.StatusNotImplemented, "Vacuum is temporarily out of order"}
 }
 
-// Re-runs the channelMapper on every document in the database.
+// Re-runs the channelMapper on every document in the database, as a background task.
 // To be used when the JavaScript channelmap function changes.
+func (db *Database) StartUpdateAllDocChannels() (*Task, error) {
+	return db.StartTask("channel_update", db.Name, db.updateAllDocChannels)
+}
+
+// Like StartUpdateAllDocChannels, but returns when it's finished.
 func (db *Database) UpdateAllDocChannels() error {
-	base.Log("Recomputing document channels...")
+	task, err := db.StartUpdateAllDocChannels()
+	if err != nil {
+		return err
+	}
+	return task.Wait()
+}
+
+func (db *Database) updateAllDocChannels(task *Task) error {
+	db.logCtx.Log("Recomputing document channels...")
 	vres, err := db.Bucket.View("sync_gateway", "all_docs", Body{"stale": false, "reduce": false})
 	if err != nil {
 		return err
 	}
-	for _, row := range vres.Rows {
+	for i, row := range vres.Rows {
+		if task.Canceled() {
+			return errTaskCanceled
+		}
 		docid := row.Key.(string)
-		key := db.realDocID(docid)
-		err := db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, error) {
-			// Be careful: this block can be invoked multiple times if there are races!
-			if currentValue == nil {
+		err := db.updateDocKeepingExpiry(docid, func(doc *document) ([]byte, error) {
+			if doc == nil {
 				return nil, couchbase.UpdateCancel // someone deleted it?!
 			}
-			doc, err := unmarshalDocument(docid, currentValue)
-			if err != nil {
-				return nil, err
-			}
 			body, err := db.getRevFromDoc(doc, "", false)
 			if err != nil {
 				return nil, err
@@ -291,12 +672,13 @@ func (db *Database) UpdateAllDocChannels() error {
 			}
 			db.updateDocAccess(doc, access)
 			db.updateDocChannels(doc, channels)
-			base.Log("\tSaving updated channels and access grants of %q", docid)
+			db.logCtx.Log("\tSaving updated channels and access grants of %q", docid)
 			return json.Marshal(doc)
 		})
 		if err != nil && err != couchbase.UpdateCancel {
-			base.Warn("Error updating doc %q: %v", docid, err)
+			db.logCtx.Warn("Error updating doc %q: %v", docid, err)
 		}
+		task.SetProgress(i+1, len(vres.Rows))
 	}
 	return nil
 }
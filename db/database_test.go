@@ -12,8 +12,11 @@ package db
 import (
 	"fmt"
 	"log"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/couchbaselabs/walrus"
 	"github.com/sdegutis/go.assert"
 
 	"github.com/couchbaselabs/sync_gateway/auth"
@@ -51,9 +54,8 @@ func tearDownTestDB(t *testing.T, db *Database) {
 }
 
 func assertHTTPError(t *testing.T, err error, status int) {
-	httpErr, ok := err.(*base.HTTPError)
-	assert.True(t, ok)
-	assert.Equals(t, httpErr.Status, 500)
+	httpStatus, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equals(t, httpStatus, status)
 }
 
 func TestDatabase(t *testing.T) {
@@ -182,6 +184,55 @@ func TestAllDocs(t *testing.T) {
 		assert.DeepEquals(t, entry, ids[j])
 	}
 
+	// Query a range of IDs, with paging:
+	result, err := db.QueryAllDocIDs(AllDocsOptions{StartKey: "alldoc-20", EndKey: "alldoc-30",
+		Skip: 2, Limit: 5})
+	assertNoError(t, err, "QueryAllDocIDs failed")
+	assert.Equals(t, result.TotalRows, 99)
+	assert.Equals(t, result.Offset, 22)
+	assert.DeepEquals(t, result.Rows, []IDAndRev{ids[22], ids[24], ids[25], ids[26], ids[27]})
+
+	result, err = db.QueryAllDocIDs(AllDocsOptions{StartKey: "alldoc-30", EndKey: "alldoc-27",
+		ExcludeEnd: true, Descending: true})
+	assertNoError(t, err, "QueryAllDocIDs failed")
+	assert.Equals(t, result.Offset, 69)
+	assert.DeepEquals(t, result.Rows, []IDAndRev{ids[30], ids[29], ids[28]})
+
+	result, err = db.QueryAllDocIDs(AllDocsOptions{Keys: []string{"alldoc-10", "alldoc-23", "alldoc-11"},
+		IncludeChannels: true})
+	assertNoError(t, err, "QueryAllDocIDs failed")
+	assert.DeepEquals(t, result.Rows, []IDAndRev{
+		IDAndRev{ids[10].DocID, ids[10].RevID, []string{"KFJC", "all"}},
+		IDAndRev{ids[11].DocID, ids[11].RevID, []string{"all"}}})
+
+	// Now query as a user who can only see the KFJC channel:
+	authenticator := auth.NewAuthenticator(db.Bucket, db)
+	db.user, _ = authenticator.NewUser("kfjcfan", "letmein", channels.SetOf("KFJC"))
+	result, err = db.QueryAllDocIDs(AllDocsOptions{StartKey: "alldoc-25", Limit: 3})
+	assertNoError(t, err, "QueryAllDocIDs failed")
+	assert.Equals(t, result.TotalRows, 10)
+	assert.Equals(t, result.Offset, 3)
+	assert.DeepEquals(t, result.Rows, []IDAndRev{ids[30], ids[40], ids[50]})
+
+	result, err = db.QueryAllDocIDs(AllDocsOptions{Keys: []string{"alldoc-10", "alldoc-11"}})
+	assertNoError(t, err, "QueryAllDocIDs failed")
+	assert.DeepEquals(t, result.Rows, []IDAndRev{ids[10]})
+
+	// A user with overlapping channels sees each doc once:
+	db.user, _ = authenticator.NewUser("both", "letmein", channels.SetOf("KFJC", "all"))
+	result, err = db.QueryAllDocIDs(AllDocsOptions{StartKey: "alldoc-08", Skip: 1, Limit: 4})
+	assertNoError(t, err, "QueryAllDocIDs failed")
+	assert.Equals(t, result.TotalRows, 99)
+	assert.Equals(t, result.Offset, 9) // 8 docs before the start key, plus one skipped
+	assert.DeepEquals(t, result.Rows, []IDAndRev{ids[9], ids[10], ids[11], ids[12]})
+	result, err = db.QueryAllDocIDs(AllDocsOptions{StartKey: "alldoc-11", Limit: 3,
+		Descending: true})
+	assertNoError(t, err, "QueryAllDocIDs failed")
+	assert.Equals(t, result.TotalRows, 99)
+	assert.Equals(t, result.Offset, 87)
+	assert.DeepEquals(t, result.Rows, []IDAndRev{ids[11], ids[10], ids[9]})
+	db.user = nil
+
 	// Now check the changes feed:
 	var options ChangesOptions
 	changes, err := db.GetChanges(channels.SetOf("all"), options)
@@ -210,6 +261,283 @@ func TestAllDocs(t *testing.T) {
 		assert.Equals(t, change.Deleted, false)
 		assert.DeepEquals(t, change.Removed, channels.Set(nil))
 	}
+
+	// Filter by doc ID, with a limit:
+	options.DocIDs = []string{ids[5].DocID, ids[40].DocID, ids[70].DocID, "nosuchdoc"}
+	options.Limit = 2
+	changes, err = db.GetChanges(channels.SetOf("all"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[0].ID, ids[5].DocID)
+	assert.Equals(t, changes[1].ID, ids[40].DocID)
+}
+
+func TestRevsLimit(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.SetRevsLimit(3)
+
+	body := Body{"n": 1}
+	for i := 0; i < 5; i++ {
+		_, err := db.Put("doc", body)
+		assertNoError(t, err, "Couldn't update document")
+	}
+	gotbody, err := db.GetRev("doc", "", true, nil)
+	assertNoError(t, err, "Couldn't get document")
+	revisions := gotbody["_revisions"].(Body)
+	assert.Equals(t, revisions["start"], 5)
+	assert.Equals(t, len(revisions["ids"].([]string)), 3)
+
+	// A revision whose history goes back past the pruned revisions still attaches to the tree:
+	history := []string{"6-six"}
+	for _, id := range revisions["ids"].([]string) {
+		history = append(history, fmt.Sprintf("%d-%s", 5-len(history)+1, id))
+	}
+	history = append(history, "2-two", "1-one")
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 6}, history), "PutExistingRev failed")
+	gotbody, err = db.Get("doc")
+	assertNoError(t, err, "Couldn't get document")
+	assert.Equals(t, gotbody["_rev"], "6-six")
+}
+
+func TestCompact(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1, err := db.Put("doc", unjson(`{"n": 1, "_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	assertNoError(t, err, "Couldn't create document")
+	body := unjson(`{"n": 2, "_attachments": {"hello.txt": {"stub": true}}}`)
+	body["_rev"] = rev1
+	rev2, err := db.Put("doc", body)
+	assertNoError(t, err, "Couldn't update document")
+	body = unjson(`{"n": 3}`)
+	body["_rev"] = rev2
+	_, err = db.Put("doc", body)
+	assertNoError(t, err, "Couldn't update document")
+
+	status, err := db.Compact()
+	assertNoError(t, err, "Compact failed")
+	assert.DeepEquals(t, status, CompactionStatus{DocsProcessed: 1, DocsCompacted: 1, RevsCompacted: 2})
+
+	_, err = db.GetRev("doc", rev1, false, nil)
+	assertHTTPError(t, err, 404)
+
+	// The sync function gets a null oldDoc for a compacted parent:
+	db.ChannelMapper, err = channels.NewChannelMapper(`function(doc, oldDoc){
+		if (doc.n == 4 && oldDoc !== null) throw({forbidden: "oldDoc isn't null"});}`)
+	assertNoError(t, err, "Couldn't create channel mapper")
+
+	// A new conflicting revision can still inherit the attachment of a compacted parent:
+	body = unjson(`{"n": 4, "_attachments": {"hello.txt": {"stub": true, "revpos": 1}}}`)
+	err = db.PutExistingRev("doc", body, []string{"3-branch", rev2, rev1})
+	assertNoError(t, err, "PutExistingRev failed")
+	gotbody, err := db.GetRev("doc", "3-branch", false, nil)
+	assertNoError(t, err, "Couldn't get conflicting revision")
+	hello := BodyAttachments(gotbody)["hello.txt"].(map[string]interface{})
+	assert.Equals(t, hello["digest"], "sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=")
+
+	status, err = db.Compact()
+	assertNoError(t, err, "Compact failed")
+	assert.Equals(t, status.RevsCompacted, 0)
+}
+
+func TestPurge(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1, err := db.Put("doc", Body{"n": 1})
+	assertNoError(t, err, "Couldn't create document")
+	rev2, err := db.Put("doc", Body{"n": 2, "_rev": rev1})
+	assertNoError(t, err, "Couldn't update document")
+	err = db.PutExistingRev("doc", Body{"n": 3}, []string{"2-a", rev1})
+	assertNoError(t, err, "PutExistingRev failed")
+	current, _ := db.Get("doc")
+	currentRev := current["_rev"].(string)
+
+	// Purging the current revision makes the other branch current:
+	purged, err := db.Purge("doc", []string{currentRev, rev1})
+	assertNoError(t, err, "Purge failed")
+	assert.DeepEquals(t, purged, []string{currentRev})
+	gotbody, err := db.Get("doc")
+	assertNoError(t, err, "Couldn't get document")
+	assert.True(t, gotbody["_rev"] != currentRev)
+	_, err = db.GetRev("doc", currentRev, false, nil)
+	assertHTTPError(t, err, 404)
+	_, err = db.GetRev("doc", rev1, false, nil)
+	assertNoError(t, err, "Shared ancestor was purged")
+
+	// Purging everything removes the document:
+	purged, err = db.Purge("doc", []string{"*"})
+	assertNoError(t, err, "Purge failed")
+	assert.Equals(t, len(purged), 1)
+	_, err = db.Get("doc")
+	assertHTTPError(t, err, 404)
+	_, err = db.Purge("doc", []string{rev2})
+	assertHTTPError(t, err, 404)
+	changes, err := db.GetChanges(channels.SetOf("*"), ChangesOptions{})
+	assertNoError(t, err, "GetChanges failed")
+	assert.Equals(t, len(changes), 0)
+
+	infos, err := db.GetPurgedInfos(0)
+	assertNoError(t, err, "GetPurgedInfos failed")
+	assert.Equals(t, len(infos), 2)
+	assert.Equals(t, infos[1].DocID, "doc")
+	assert.DeepEquals(t, infos[1].Revs, purged)
+	infos, err = db.GetPurgedInfos(infos[0].Seq)
+	assertNoError(t, err, "GetPurgedInfos failed")
+	assert.Equals(t, len(infos), 1)
+}
+
+func TestPurgeLogRetention(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Filling one more shard than is kept makes the oldest one go away:
+	for i := 0; i < kPurgeLogMaxShards*kPurgeLogShardSize+1; i++ {
+		assertNoError(t, db.logPurge(fmt.Sprintf("doc%d", i), []string{"1-a"}, nil), "logPurge failed")
+	}
+	_, err := db.Bucket.GetRaw(purgeLogShardKey(0))
+	assertHTTPError(t, err, 404)
+	infos, err := db.GetPurgedInfos(0)
+	assertNoError(t, err, "GetPurgedInfos failed")
+	assert.Equals(t, len(infos), (kPurgeLogMaxShards-1)*kPurgeLogShardSize+1)
+	assert.Equals(t, infos[0].DocID, fmt.Sprintf("doc%d", kPurgeLogShardSize))
+	assert.Equals(t, infos[len(infos)-1].DocID, fmt.Sprintf("doc%d", kPurgeLogMaxShards*kPurgeLogShardSize))
+
+	// Asking for recent purges only reads the shards it needs:
+	infos, err = db.GetPurgedInfos(infos[len(infos)-2].Seq)
+	assertNoError(t, err, "GetPurgedInfos failed")
+	assert.Equals(t, len(infos), 1)
+}
+
+func TestExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	expiry, err := parseExpiry(float64(60))
+	assertNoError(t, err, "parseExpiry failed")
+	assert.True(t, int64(expiry) > time.Now().Unix())
+	expiry, err = parseExpiry("2030-01-01T00:00:00Z")
+	assertNoError(t, err, "parseExpiry failed")
+	assert.Equals(t, expiry, uint32(1893456000))
+	_, err = parseExpiry("tomorrow")
+	assertHTTPError(t, err, 400)
+	_, err = parseExpiry(float64(-1))
+	assertHTTPError(t, err, 400)
+
+	_, err = db.Put("fresh", Body{"_exp": float64(3600)})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Put("stale", Body{"_exp": "2000-01-01T00:00:00Z"})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Put("stale", Body{"_exp": "soon"})
+	assertHTTPError(t, err, 400)
+
+	// An expired doc can't be read, even before it's been swept:
+	_, err = db.Get("stale")
+	assertHTTPError(t, err, 404)
+
+	count, err := db.ExpireDocs()
+	assertNoError(t, err, "ExpireDocs failed")
+	assert.Equals(t, count, 1)
+	_, err = db.Get("fresh")
+	assertNoError(t, err, "Unexpired doc is missing")
+
+	// The expired doc shows up in the changes feed as a deletion:
+	changes, err := db.GetChanges(channels.SetOf("*"), ChangesOptions{})
+	assertNoError(t, err, "GetChanges failed")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[1].ID, "stale")
+	assert.True(t, changes[1].Deleted)
+
+	count, err = db.ExpireDocs()
+	assertNoError(t, err, "ExpireDocs failed")
+	assert.Equals(t, count, 0)
+}
+
+// A Bucket that remembers the expiry last given to Update for each key.
+type expiryRecordingBucket struct {
+	base.Bucket
+	expiries map[string]int
+}
+
+func (bucket *expiryRecordingBucket) Update(k string, exp int, callback walrus.UpdateFunc) error {
+	bucket.expiries[k] = exp
+	return bucket.Bucket.Update(k, exp, callback)
+}
+
+func TestMaintenanceKeepsExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1, err := db.Put("doc", Body{"n": 1, "_exp": float64(3600)})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Put("doc", Body{"n": 2, "_rev": rev1, "_exp": float64(3600)})
+	assertNoError(t, err, "Couldn't update document")
+	doc, err := db.getDoc("doc")
+	assertNoError(t, err, "Couldn't get document")
+	expiry := doc.Expiry
+	assert.True(t, expiry != 0)
+	err = db.PutExistingRev("doc", Body{"n": 3, "_exp": float64(expiry)}, []string{"2-conflict", rev1})
+	assertNoError(t, err, "PutExistingRev failed")
+
+	bucket := &expiryRecordingBucket{db.Bucket, map[string]int{}}
+	db.Bucket = bucket
+	status, err := db.Compact()
+	assertNoError(t, err, "Compact failed")
+	assert.Equals(t, status.RevsCompacted, 1)
+	assert.Equals(t, bucket.expiries["doc"], bucketExpiry(expiry))
+
+	delete(bucket.expiries, "doc")
+	assertNoError(t, db.UpdateAllDocChannels(), "UpdateAllDocChannels failed")
+	assert.Equals(t, bucket.expiries["doc"], bucketExpiry(expiry))
+
+	delete(bucket.expiries, "doc")
+	purged, err := db.Purge("doc", []string{"2-conflict"})
+	assertNoError(t, err, "Purge failed")
+	assert.DeepEquals(t, purged, []string{"2-conflict"})
+	assert.Equals(t, bucket.expiries["doc"], bucketExpiry(expiry))
+
+	doc, err = db.getDoc("doc")
+	assertNoError(t, err, "Couldn't get document")
+	assert.Equals(t, doc.Expiry, expiry)
+}
+
+func TestReplicatorLocalChanges(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	for i := 0; i < kReplicationBatchSize+10; i++ {
+		_, err := db.Put(fmt.Sprintf("doc%d", i), Body{"n": i})
+		assertNoError(t, err, "Couldn't create document")
+	}
+	r := &Replicator{db: db, push: true, stop: make(chan bool)}
+	changes, err := r.getLocalChanges("", false)
+	assertNoError(t, err, "getLocalChanges failed")
+	assert.Equals(t, len(changes), kReplicationBatchSize)
+
+	// Waits that time out share a single goroutine waiting for a revision:
+	defer func(interval time.Duration) { ReplicationPollInterval = interval }(ReplicationPollInterval)
+	ReplicationPollInterval = time.Millisecond
+	lastSeq, _ := db.LastSequence()
+	since := fmt.Sprint(lastSeq)
+	changes, err = r.getLocalChanges(since, true)
+	assertNoError(t, err, "getLocalChanges failed")
+	assert.Equals(t, len(changes), 0)
+	waiter := r.revWaiter
+	assert.True(t, waiter != nil)
+	_, err = r.getLocalChanges(since, true)
+	assertNoError(t, err, "getLocalChanges failed")
+	assert.True(t, r.revWaiter == waiter)
+
+	// Let the waiting goroutine finish:
+	for done := false; !done; {
+		db.NotifyRevision()
+		select {
+		case <-waiter:
+			done = true
+		case <-time.After(time.Millisecond):
+		}
+	}
 }
 
 func TestInvalidChannel(t *testing.T) {
@@ -223,6 +551,97 @@ func TestInvalidChannel(t *testing.T) {
 	assertHTTPError(t, err, 500)
 }
 
+func TestUpdateAllOrNothing(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	var err error
+	db.ChannelMapper, err = channels.NewChannelMapper(`function(doc){
+		if (doc.bad) throw({forbidden: "bad doc"});}`)
+	assertNoError(t, err, "Couldn't create channel mapper")
+
+	rev1, err := db.Put("aon1", Body{"n": 1})
+	assertNoError(t, err, "Couldn't create doc")
+
+	// If the sync function rejects one doc, none are saved, not even attachments:
+	updates := []DocUpdate{
+		{DocID: "aon1", Body: Body{"_rev": rev1, "n": 2}},
+		{DocID: "aon2", Body: unjson(`{"n": 1, "_attachments": {"a.txt": {"data": "YWFhYWFh"}}}`)},
+		{DocID: "aon3", Body: Body{"bad": true}},
+	}
+	_, err = db.UpdateAllOrNothing(updates)
+	assertHTTPError(t, err, 403)
+	body, err := db.Get("aon1")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, body["_rev"], rev1)
+	_, err = db.Get("aon2")
+	assertHTTPError(t, err, 404)
+	_, err = db.GetAttachment(AttachmentKey(sha1DigestKey([]byte("aaaaaa"))))
+	assertHTTPError(t, err, 404)
+
+	// A doc can't be updated twice in one batch:
+	updates = []DocUpdate{
+		{DocID: "aon2", Body: Body{"n": 1}},
+		{DocID: "aon2", Body: Body{"n": 2}},
+	}
+	_, err = db.UpdateAllOrNothing(updates)
+	assertHTTPError(t, err, 400)
+	_, err = db.Get("aon2")
+	assertHTTPError(t, err, 404)
+
+	// If a save fails, the docs already saved are put back as they were, with new sequences:
+	doc, _ := db.getDoc("aon1")
+	oldSequence := doc.Sequence
+	realBucket := db.Bucket
+	db.Bucket = &failingUpdateBucket{db.Bucket, "aon3"}
+	updates = []DocUpdate{
+		{DocID: "aon1", Body: Body{"_rev": rev1, "n": 2}},
+		{DocID: "aon2", Body: Body{"n": 1}},
+		{DocID: "aon3", Body: Body{"n": 1}},
+	}
+	_, err = db.UpdateAllOrNothing(updates)
+	assertHTTPError(t, err, 503)
+	db.Bucket = realBucket
+	body, err = db.Get("aon1")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, body["_rev"], rev1)
+	assert.Equals(t, body["n"], float64(1))
+	doc, _ = db.getDoc("aon1")
+	assert.True(t, doc.Sequence > oldSequence)
+	_, err = db.getDoc("aon2")
+	assertHTTPError(t, err, 404)
+
+	// Success:
+	updates = []DocUpdate{
+		{DocID: "aon1", Body: Body{"_rev": rev1, "n": 2}},
+		{Body: Body{"n": 1}},
+	}
+	revids, err := db.UpdateAllOrNothing(updates)
+	assertNoError(t, err, "UpdateAllOrNothing failed")
+	assert.Equals(t, len(revids), 2)
+	assert.True(t, strings.HasPrefix(revids[0], "2-"))
+	body, err = db.Get("aon1")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, body["_rev"], revids[0])
+	assert.True(t, updates[1].DocID != "")
+	body, err = db.Get(updates[1].DocID)
+	assertNoError(t, err, "Couldn't get doc")
+	assert.Equals(t, body["_rev"], revids[1])
+}
+
+// A Bucket whose updates of one key fail.
+type failingUpdateBucket struct {
+	base.Bucket
+	failKey string
+}
+
+func (bucket *failingUpdateBucket) Update(k string, exp int, callback walrus.UpdateFunc) error {
+	if k == bucket.failKey {
+		return &base.HTTPError{503, "Simulated failure"}
+	}
+	return bucket.Bucket.Update(k, exp, callback)
+}
+
 func TestAccessFunctionValidation(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -287,3 +706,39 @@ func TestAccessFunction(t *testing.T) {
 	assert.DeepEquals(t, user.Channels(), channels.SetOf("Hulu", "Netflix"))
 	assert.DeepEquals(t, user.InheritedChannels(), channels.SetOf("Hulu", "CrunchyRoll", "Netflix"))
 }
+
+func TestTasks(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	started := make(chan bool)
+	task, err := db.StartTask("test", "one", func(task *Task) error {
+		task.SetProgress(1, 4)
+		started <- true
+		for !task.Canceled() {
+			time.Sleep(time.Millisecond)
+		}
+		return errTaskCanceled
+	})
+	assertNoError(t, err, "StartTask failed")
+	<-started
+	_, err = db.StartTask("test", "one", func(task *Task) error { return nil })
+	assertHTTPError(t, err, 409)
+
+	tasks := db.ActiveTasks()
+	assert.Equals(t, len(tasks), 1)
+	info := tasks[0].Info()
+	assert.Equals(t, info["task_id"], "test-one")
+	assert.Equals(t, info["type"], "test")
+	assert.Equals(t, info["progress"], 25)
+
+	assertHTTPError(t, db.CancelTask("test-two"), 404)
+	assertNoError(t, db.CancelTask(task.ID()), "CancelTask failed")
+	assert.Equals(t, task.Wait(), error(errTaskCanceled))
+	assert.Equals(t, len(db.ActiveTasks()), 0)
+
+	// A synchronous operation runs as a task too:
+	_, err = db.Put("taskdoc", Body{"n": 1})
+	assertNoError(t, err, "Couldn't create document")
+	assertNoError(t, db.UpdateAllDocChannels(), "UpdateAllDocChannels failed")
+}
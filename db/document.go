@@ -30,6 +30,7 @@ type syncData struct {
 	History    RevTree            `json:"history"`
 	Channels   ChannelMap         `json:"channels,omitempty"`
 	Access     channels.AccessMap `json:"access,omitempty"`
+	Expiry     uint32             `json:"exp,omitempty"` // Unix time the doc expires, if nonzero
 }
 
 // A document as stored in Couchbase. Contains the body of the current revision plus metadata.
@@ -62,6 +63,8 @@ func (doc *document) getRevision(revid string) Body {
 	var body Body
 	if revid == doc.CurrentRev {
 		body = doc.body
+	} else if doc.History[revid].Compacted {
+		return nil
 	} else {
 		body = doc.History.getParsedRevisionBody(revid)
 		if body == nil {
@@ -78,6 +81,8 @@ func (doc *document) getRevisionJSON(revid string) []byte {
 	var bodyJSON []byte
 	if revid == doc.CurrentRev {
 		bodyJSON, _ = json.Marshal(doc.body)
+	} else if doc.History[revid].Compacted {
+		return nil
 	} else {
 		bodyJSON, _ = doc.History.getRevisionBody(revid)
 	}
@@ -0,0 +1,177 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Like Couchbase, an "_exp" value up to this many seconds is relative to the current time;
+// larger values are absolute Unix times.
+const kMaxRelativeExpiry = 30 * 24 * 60 * 60
+
+// Couchbase removes an expiring document this many seconds after its expiry time. The delay
+// gives ExpireDocs time to replace it with a tombstone, so _changes feeds will announce it.
+const kExpiryGracePeriod = 10 * 60
+
+// How often the databases started with StartExpiry look for expired documents.
+var ExpiryCheckInterval = time.Minute
+
+// Parses the value of a document's "_exp" property into a Unix time (or 0 if there's none.)
+// The value can be a number of seconds (relative or absolute, as in Couchbase), or a string
+// containing such a number or an RFC 3339 timestamp.
+func parseExpiry(value interface{}) (uint32, error) {
+	var seconds float64
+	switch value := value.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		seconds = value
+	case string:
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			seconds = number
+		} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+			seconds = float64(t.Unix())
+		} else {
+			return 0, &base.HTTPError{http.StatusBadRequest, "Invalid _exp timestamp"}
+		}
+	default:
+		return 0, &base.HTTPError{http.StatusBadRequest, "Invalid _exp property"}
+	}
+	if seconds < 0 || seconds > float64(^uint32(0)-kExpiryGracePeriod) {
+		return 0, &base.HTTPError{http.StatusBadRequest, "Invalid _exp property"}
+	} else if seconds > 0 && seconds <= kMaxRelativeExpiry {
+		seconds += float64(time.Now().Unix())
+	}
+	return uint32(seconds), nil
+}
+
+// The expiry to give Bucket.Update for a document expiring at a Unix time (0 for none.)
+func bucketExpiry(expiry uint32) int {
+	if expiry == 0 {
+		return 0
+	}
+	return int(expiry + kExpiryGracePeriod)
+}
+
+var errExpiryChanged = errors.New("document's expiry changed")
+
+// Updates a document's bucket value without an update of its revisions, keeping its expiry.
+// The callback gets the current document (nil if there isn't one) and returns the new value.
+// Bucket.Update needs the expiry up front, so the doc is read first, and if its expiry has
+// changed by the time the callback runs, the whole thing starts over.
+func (db *Database) updateDocKeepingExpiry(docid string, callback func(*document) ([]byte, error)) error {
+	key := db.realDocID(docid)
+	if key == "" {
+		return &base.HTTPError{Status: 400, Message: "Invalid doc ID"}
+	}
+	for {
+		var expiry uint32
+		if doc, err := db.getDoc(docid); err == nil {
+			expiry = doc.Expiry
+		} else if status, _ := base.ErrorAsHTTPStatus(err); status != http.StatusNotFound {
+			return err
+		}
+		err := db.Bucket.Update(key, bucketExpiry(expiry), func(currentValue []byte) ([]byte, error) {
+			// Be careful: this block can be invoked multiple times if there are races!
+			if currentValue == nil {
+				return callback(nil)
+			}
+			doc, err := unmarshalDocument(docid, currentValue)
+			if err != nil {
+				return nil, err
+			} else if doc.Expiry != expiry {
+				return nil, errExpiryChanged
+			}
+			return callback(doc)
+		})
+		if err != errExpiryChanged {
+			return err
+		}
+	}
+}
+
+// Returns true if the document's expiry time has passed.
+func (doc *document) isExpired() bool {
+	return doc.Expiry != 0 && int64(doc.Expiry) <= time.Now().Unix()
+}
+
+// Replaces every expired document with a tombstone (a deletion revision), so that _changes
+// feeds will tell clients it's gone. Returns the number of documents expired.
+func (db *Database) ExpireDocs() (int, error) {
+	opts := Body{"stale": false, "endkey": time.Now().Unix()}
+	vres, err := db.Bucket.View("sync_gateway", "expiry", opts)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, row := range vres.Rows {
+		docid := row.ID
+		revid, err := db.updateDoc(docid, 0, func(doc *document) (Body, error) {
+			// Be careful: this block can be invoked multiple times if there are races!
+			if !doc.isExpired() || doc.Deleted {
+				return nil, couchbase.UpdateCancel // it was updated since the view was indexed
+			}
+			callback, err := db.putCallback(Body{"_deleted": true, "_rev": doc.CurrentRev})
+			if err != nil {
+				return nil, err
+			}
+			return callback(doc)
+		})
+		if err != nil {
+			db.logCtx.Warn("Error expiring doc %q: %v", docid, err)
+		} else if revid != "" {
+			db.logCtx.LogTo("CRUD", "\tExpired doc %q", docid)
+			count++
+		}
+	}
+	if count > 0 {
+		db.logCtx.Log("Expired %d docs of database %q", count, db.Name)
+	}
+	return count, nil
+}
+
+// Starts a goroutine that periodically calls ExpireDocs, until Close is called.
+func (context *DatabaseContext) StartExpiry() {
+	stop := make(chan bool)
+	context.stopExpiry = stop
+	go func() {
+		ticker := time.NewTicker(ExpiryCheckInterval)
+		defer ticker.Stop()
+		db := &Database{context, nil, context.newLogContext(nil)}
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := db.ExpireDocs(); err != nil {
+					db.logCtx.Warn("Error expiring docs of database %q: %v", db.Name, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops background tasks and closes the bucket.
+func (context *DatabaseContext) Close() {
+	if context.stopExpiry != nil {
+		close(context.stopExpiry)
+		context.stopExpiry = nil
+	}
+	context.cancelAllTasks()
+	context.Bucket.Close()
+}
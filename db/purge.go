@@ -0,0 +1,207 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// The log of purged revisions is split into shards of kPurgeLogShardSize entries, stored in
+// docs "_sync:purges:0", "_sync:purges:1", ... Only the newest kPurgeLogMaxShards are kept.
+const (
+	kPurgeLogCountKey  = "_sync:purgecount" // Counter of entries ever added to the log
+	kPurgeLogShardKey  = "_sync:purges:%d"
+	kPurgeLogShardSize = 100
+	kPurgeLogMaxShards = 10
+)
+
+// A record of a purge, kept so that clients can be told to drop their local copies.
+type PurgedInfo struct {
+	Seq      uint64   `json:"seq"`      // Sequence number assigned to the purge
+	DocID    string   `json:"id"`       // ID of the purged document
+	Revs     []string `json:"revs"`     // Leaf revisions that were purged
+	Channels []string `json:"channels"` // Channels the document was in
+}
+
+type purgeLog struct {
+	Purges []PurgedInfo `json:"purges"`
+}
+
+// Permanently removes leaf revisions of a document, along with those of their ancestors that
+// aren't shared with a remaining leaf. If no leaves remain, or revids contains "*", the entire
+// document is removed from the bucket. (Unlike DeleteDoc, this leaves no tombstone.)
+// Revision IDs that aren't leaves are ignored. Returns the IDs of the purged leaf revisions.
+func (db *Database) Purge(docid string, revids []string) ([]string, error) {
+	var purged []string
+	var docChannels []string
+	err := db.updateDocKeepingExpiry(docid, func(doc *document) ([]byte, error) {
+		if doc == nil {
+			return nil, &base.HTTPError{Status: http.StatusNotFound, Message: "missing"}
+		}
+		var err error
+		docChannels = currentChannels(doc.Channels)
+		toPurge := revids
+		for _, revid := range revids {
+			if revid == "*" {
+				toPurge = doc.History.getLeaves()
+				break
+			}
+		}
+		if purged = doc.History.purgeLeaves(toPurge); len(purged) == 0 {
+			return nil, couchbase.UpdateCancel
+		}
+
+		if len(doc.History) == 0 {
+			// Nothing's left, so remove the document entirely (revoking any access it granted):
+			db.updateDocAccess(doc, nil)
+			return nil, nil
+		} else if !doc.History.contains(doc.CurrentRev) {
+			// The current revision was purged, so the winning conflict takes its place:
+			doc.CurrentRev = doc.History.winningRevision()
+			doc.Deleted = doc.History[doc.CurrentRev].Deleted
+			doc.body = doc.History.getParsedRevisionBody(doc.CurrentRev)
+			doc.History.setRevisionBody(doc.CurrentRev, nil)
+			if doc.Sequence, err = db.sequences.nextSequence(); err != nil {
+				return nil, err
+			}
+
+			body := copyBody(doc.body)
+			body["_id"] = doc.ID
+			body["_rev"] = doc.CurrentRev
+			if doc.Deleted {
+				body["_deleted"] = true
+			}
+			parentRevID := doc.History[doc.CurrentRev].Parent
+			channels, access, err := db.getChannelsAndAccess(doc, body, parentRevID)
+			if err != nil {
+				// Probably the validator rejected the doc
+				channels = nil
+				access = nil
+			}
+			db.updateDocChannels(doc, channels)
+			db.updateDocAccess(doc, access)
+		}
+		return json.Marshal(doc)
+	})
+
+	if err == couchbase.UpdateCancel {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	db.logCtx.Log("Purged doc %q revisions %v", docid, purged)
+	db.NotifyRevision()
+	if err := db.logPurge(docid, purged, docChannels); err != nil {
+		// The purge itself has already happened, so don't report it as a failure:
+		db.logCtx.Warn("Couldn't add purge of doc %q to the purge log: %v", docid, err)
+	}
+	return purged, nil
+}
+
+func purgeLogShardKey(shard uint64) string {
+	return fmt.Sprintf(kPurgeLogShardKey, shard)
+}
+
+// Appends an entry to the purge log, deleting the oldest shard when a new one is started.
+func (db *Database) logPurge(docid string, revids []string, channels []string) error {
+	seq, err := db.sequences.nextSequence()
+	if err != nil {
+		return err
+	}
+	count, err := db.Bucket.Incr(kPurgeLogCountKey, 1, 1, 0)
+	if err != nil {
+		return err
+	}
+	index := count - 1
+	shard := index / kPurgeLogShardSize
+	if index%kPurgeLogShardSize == 0 && shard >= kPurgeLogMaxShards {
+		if err := db.Bucket.Delete(purgeLogShardKey(shard - kPurgeLogMaxShards)); err != nil {
+			db.logCtx.Warn("Couldn't delete old purge log shard: %v", err)
+		}
+	}
+	entry := PurgedInfo{Seq: seq, DocID: docid, Revs: revids, Channels: channels}
+	return db.Bucket.Update(purgeLogShardKey(shard), 0, func(currentValue []byte) ([]byte, error) {
+		var log purgeLog
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &log); err != nil {
+				return nil, err
+			}
+		}
+		log.Purges = append(log.Purges, entry)
+		return json.Marshal(log)
+	})
+}
+
+// Returns the purges made after the sequence 'since', of documents in channels the user can
+// access. Purges that have aged out of the log aren't returned.
+func (db *Database) GetPurgedInfos(since uint64) ([]PurgedInfo, error) {
+	var count uint64
+	if err := db.Bucket.Get(kPurgeLogCountKey, &count); err != nil {
+		if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusNotFound {
+			return []PurgedInfo{}, nil
+		}
+		return nil, err
+	}
+
+	// Read shards newest-first, until reaching one that's entirely at or before 'since':
+	var shards [][]PurgedInfo
+	for i := uint64(0); i < kPurgeLogMaxShards && i*kPurgeLogShardSize < count; i++ {
+		shard := (count-1)/kPurgeLogShardSize - i
+		var log purgeLog
+		if err := db.Bucket.Get(purgeLogShardKey(shard), &log); err != nil {
+			if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusNotFound {
+				break
+			}
+			return nil, err
+		}
+		shards = append(shards, log.Purges)
+		if len(log.Purges) > 0 && log.Purges[len(log.Purges)-1].Seq <= since {
+			break
+		}
+	}
+
+	result := []PurgedInfo{}
+	for i := len(shards) - 1; i >= 0; i-- {
+		for _, entry := range shards[i] {
+			if entry.Seq > since && db.canSeePurge(entry) {
+				result = append(result, entry)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *Database) canSeePurge(entry PurgedInfo) bool {
+	if db.user == nil {
+		return true
+	}
+	channels := ChannelMap{}
+	for _, channel := range entry.Channels {
+		channels[channel] = nil
+	}
+	return AuthorizeAnyDocChannels(db.user, channels) == nil
+}
+
+// Returns the names of the channels in a ChannelMap that the doc hasn't been removed from.
+func currentChannels(channels ChannelMap) []string {
+	result := []string{}
+	for channel, removal := range channels {
+		if removal == nil {
+			result = append(result, channel)
+		}
+	}
+	return result
+}
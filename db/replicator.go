@@ -0,0 +1,675 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// Maximum number of changes requested from the remote database at once.
+const kReplicationBatchSize = 100
+
+// How long a continuous replication waits before retrying after an error.
+var ReplicationRetryInterval = 10 * time.Second
+
+// How often a continuous push replication checks for changes, in case it missed a notification.
+var ReplicationPollInterval = time.Minute
+
+// Replicators have their own Transport so that Stop can cancel a request in progress.
+var replicatorTransport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+var replicatorClient = &http.Client{Transport: replicatorTransport}
+
+// Parameters of a replication between a local database and a remote CouchDB-compatible one.
+type ReplicationParams struct {
+	Remote     string   // URL of the remote database
+	Channels   []string // If non-empty, only docs in these channels are replicated
+	DocIDs     []string // If non-empty, only docs with these IDs are replicated
+	Continuous bool     // If true, keeps replicating new changes until stopped
+}
+
+// The progress of a replication, in the same form as CouchDB's replication history.
+type ReplicationStats struct {
+	LastSeq          string `json:"source_last_seq,omitempty"`
+	MissingChecked   int    `json:"missing_checked"`
+	MissingFound     int    `json:"missing_found"`
+	DocsRead         int    `json:"docs_read"`
+	DocsWritten      int    `json:"docs_written"`
+	DocWriteFailures int    `json:"doc_write_failures"`
+}
+
+// Runs a replication using the CouchDB replication protocol, talking to the remote database
+// over HTTP and to the local one directly.
+type Replicator struct {
+	db            *Database
+	params        ReplicationParams
+	push          bool   // True if pushing to the remote, false if pulling from it
+	remote        string // Remote URL, ending with "/"
+	remoteName    string // Remote URL without credentials, for logging
+	id            string // Unique ID of the replication, also used as the checkpoint doc ID
+	checkpointRev string // Current _rev of the checkpoint doc
+	noBulkGet     bool   // Set if the remote doesn't support _bulk_get
+	stats         ReplicationStats
+	stop          chan bool
+	request       *http.Request // The HTTP request in progress, if any
+	requestLock   sync.Mutex
+	task          *Task     // The task running the replication, if any
+	revWaiter     chan bool // Signaled by the goroutine waiting for a local revision, if any
+}
+
+// An entry in the _changes feed being replicated (the remote's when pulling, the local
+// database's when pushing.)
+type feedChange struct {
+	Seq     json.RawMessage `json:"seq"`
+	ID      string          `json:"id"`
+	Changes []ChangeRev     `json:"changes"`
+}
+
+// The change's sequence ID (a JSON number or string) in the form to pass as "since".
+func (change feedChange) since() string {
+	var str string
+	if json.Unmarshal(change.Seq, &str) == nil {
+		return str
+	}
+	return string(change.Seq)
+}
+
+// Creates a Replicator that pulls revisions from a remote database into the local one.
+func NewPullReplicator(db *Database, params ReplicationParams) (*Replicator, error) {
+	return newReplicator(db, params, false)
+}
+
+// Creates a Replicator that pushes revisions from the local database to a remote one.
+func NewPushReplicator(db *Database, params ReplicationParams) (*Replicator, error) {
+	return newReplicator(db, params, true)
+}
+
+func newReplicator(db *Database, params ReplicationParams, push bool) (*Replicator, error) {
+	remoteURL, err := url.Parse(params.Remote)
+	if err != nil || (remoteURL.Scheme != "http" && remoteURL.Scheme != "https") {
+		return nil, &base.HTTPError{http.StatusBadRequest, "Invalid remote database URL"}
+	}
+	if !push && len(params.Channels) > 0 && len(params.DocIDs) > 0 {
+		// A remote _changes feed can only apply one filter at a time
+		return nil, &base.HTTPError{http.StatusBadRequest, "Can't pull by both channels and doc_ids"}
+	}
+	if !strings.HasSuffix(remoteURL.Path, "/") {
+		remoteURL.Path += "/"
+	}
+	r := &Replicator{
+		db:     db,
+		params: params,
+		push:   push,
+		remote: remoteURL.String(),
+		stop:   make(chan bool),
+	}
+
+	// The ID is a digest of everything that determines which revisions get replicated. (The
+	// remote's credentials are left out, so changing a password doesn't reset the checkpoint.)
+	remoteURL.User = nil
+	r.remoteName = remoteURL.String()
+	digest := sha1.New()
+	fmt.Fprintf(digest, "%v\n%s\n%s\n%v\n%v", push, remoteURL, db.Name, params.Channels, params.DocIDs)
+	r.id = fmt.Sprintf("%x", digest.Sum(nil))
+	return r, nil
+}
+
+// The replication's ID. Replications with the same parameters have the same ID.
+func (r *Replicator) ID() string {
+	return r.id
+}
+
+// The replication's progress so far.
+func (r *Replicator) Stats() ReplicationStats {
+	return r.stats
+}
+
+func (r *Replicator) String() string {
+	if r.push {
+		return fmt.Sprintf("push from %q to <%s>", r.db.Name, r.remoteName)
+	}
+	return fmt.Sprintf("pull from <%s> into %q", r.remoteName, r.db.Name)
+}
+
+// Runs the replication. A one-shot replication returns when it's caught up with the source;
+// a continuous one returns only after Stop is called.
+func (r *Replicator) Run() error {
+	r.db.logCtx.Log("Replicator: Starting %s", r)
+	since, err := r.readCheckpoint()
+	if err != nil {
+		return err
+	}
+	wait := false
+	for !r.stopped() {
+		var changes []feedChange
+		if r.push {
+			changes, err = r.getLocalChanges(since, wait)
+		} else {
+			changes, err = r.getRemoteChanges(since, wait)
+		}
+		for start := 0; err == nil && start < len(changes); start += kReplicationBatchSize {
+			batch := changes[start:]
+			if len(batch) > kReplicationBatchSize {
+				batch = batch[:kReplicationBatchSize]
+			}
+			if r.push {
+				err = r.pushRevisions(batch)
+			} else {
+				err = r.pullRevisions(batch)
+			}
+			if err == nil {
+				since = batch[len(batch)-1].since()
+				r.stats.LastSeq = since
+				err = r.saveCheckpoint(since)
+			}
+			r.reportProgress()
+		}
+		if err != nil {
+			if !r.params.Continuous {
+				break
+			} else if r.stopped() {
+				err = nil // probably the request was canceled by Stop
+				break
+			}
+			r.db.logCtx.Warn("Replicator: Error in %s (will retry): %v", r, err)
+			err = nil
+			wait = false
+			select {
+			case <-time.After(ReplicationRetryInterval):
+			case <-r.stop:
+			}
+		} else if len(changes) < kReplicationBatchSize {
+			if !r.params.Continuous {
+				break
+			}
+			wait = true // caught up, so wait for more changes
+		}
+	}
+	r.db.logCtx.Log("Replicator: Finished %s: %+v (err=%v)", r, r.stats, err)
+	return err
+}
+
+// Tells a running replication to stop, canceling any request it's waiting on.
+func (r *Replicator) Stop() {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	r.requestLock.Lock()
+	defer r.requestLock.Unlock()
+	if r.request != nil {
+		replicatorTransport.CancelRequest(r.request)
+	}
+}
+
+func (r *Replicator) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+//////// CHECKPOINTS:
+
+// Reads the source sequence that the last run of this replication got up to.
+func (r *Replicator) readCheckpoint() (string, error) {
+	body, err := r.db.GetSpecial("local", r.id)
+	if err != nil {
+		if isMissingDocError(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	r.checkpointRev, _ = body["_rev"].(string)
+	since, _ := body["last_sequence"].(string)
+	return since, nil
+}
+
+// Records the source sequence the replication has gotten up to, in a _local doc.
+func (r *Replicator) saveCheckpoint(since string) error {
+	body := Body{"last_sequence": since}
+	if r.checkpointRev != "" {
+		body["_rev"] = r.checkpointRev
+	}
+	revid, err := r.db.PutSpecial("local", r.id, body)
+	if err != nil {
+		return err
+	}
+	r.checkpointRev = revid
+	return nil
+}
+
+//////// PULLING:
+
+// Gets the next batch of changes from the remote database. If 'wait' is true, it's a longpoll
+// request that waits for a change to arrive.
+func (r *Replicator) getRemoteChanges(since string, wait bool) ([]feedChange, error) {
+	query := url.Values{}
+	query.Set("style", "all_docs")
+	query.Set("limit", fmt.Sprint(kReplicationBatchSize))
+	if since != "" {
+		query.Set("since", since)
+	}
+	if wait {
+		query.Set("feed", "longpoll")
+	}
+	if len(r.params.Channels) > 0 {
+		query.Set("filter", "sync_gateway/bychannel")
+		query.Set("channels", strings.Join(r.params.Channels, ","))
+	} else if len(r.params.DocIDs) > 0 {
+		docIDs, _ := json.Marshal(r.params.DocIDs)
+		query.Set("filter", "_doc_ids")
+		query.Set("doc_ids", string(docIDs))
+	}
+
+	var result struct {
+		Results []feedChange `json:"results"`
+	}
+	if _, err := r.sendRequest("GET", "_changes?"+query.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
+
+// Finds which of the changed revisions are missing locally, then fetches and saves them.
+func (r *Replicator) pullRevisions(changes []feedChange) error {
+	input := RevsDiffInput{}
+	for _, change := range changes {
+		for _, rev := range change.Changes {
+			input[change.ID] = append(input[change.ID], rev["rev"])
+			r.stats.MissingChecked++
+		}
+	}
+	diffs, err := r.db.RevsDiff(input)
+	if err != nil {
+		return err
+	}
+
+	requests := make([]Body, 0, len(diffs))
+	for docid, diff := range diffs {
+		diff := diff.(map[string]interface{})
+		missing := diff["missing"].([]string)
+		r.stats.MissingFound += len(missing)
+		for _, revid := range missing {
+			request := Body{"id": docid, "rev": revid}
+			if possible, ok := diff["possible_ancestors"].([]string); ok {
+				request["atts_since"] = possible
+			}
+			requests = append(requests, request)
+		}
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+
+	if !r.noBulkGet {
+		revs, err := r.bulkGet(requests)
+		if !r.noBulkGet {
+			if err != nil {
+				return err
+			}
+			r.storeRevisions(revs)
+			return nil
+		}
+	}
+	for _, request := range requests {
+		revs, err := r.getOpenRevs(request)
+		if err != nil {
+			return err
+		}
+		r.storeRevisions(revs)
+	}
+	return nil
+}
+
+// Fetches revisions from the remote with a _bulk_get request. If the remote doesn't support
+// _bulk_get, sets r.noBulkGet instead.
+func (r *Replicator) bulkGet(requests []Body) ([]Body, error) {
+	var revs []Body
+	status, err := r.sendRequest("POST", "_bulk_get?revs=true&attachments=true",
+		Body{"docs": requests}, &revs)
+	if status == http.StatusBadRequest || status == http.StatusNotFound ||
+		status == http.StatusMethodNotAllowed {
+		r.db.logCtx.LogTo("Replicate", "Remote <%s> doesn't support _bulk_get; using open_revs", r.remoteName)
+		r.noBulkGet = true
+	}
+	return revs, err
+}
+
+// Fetches a revision from the remote with a GET using the open_revs parameter.
+func (r *Replicator) getOpenRevs(request Body) ([]Body, error) {
+	docid := request["id"].(string)
+	query := url.Values{}
+	query.Set("revs", "true")
+	query.Set("attachments", "true")
+	openRevs, _ := json.Marshal([]interface{}{request["rev"]})
+	query.Set("open_revs", string(openRevs))
+	if attsSince, ok := request["atts_since"]; ok {
+		attsSinceJSON, _ := json.Marshal(attsSince)
+		query.Set("atts_since", string(attsSinceJSON))
+	}
+	path := strings.Replace(url.QueryEscape(docid), "+", "%20", -1) + "?" + query.Encode()
+
+	rq, _ := http.NewRequest("GET", r.remote+path, nil)
+	rq.Header.Set("Accept", "multipart/mixed, application/json")
+	response, err := r.send(rq)
+	if err != nil {
+		return nil, err
+	}
+	defer r.endRequest(response)
+	if response.StatusCode >= 300 {
+		return nil, &base.HTTPError{response.StatusCode,
+			fmt.Sprintf("GET %s from remote: %s", docid, response.Status)}
+	}
+
+	var revs []Body
+	contentType, attrs, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if contentType == "multipart/mixed" {
+		// Each part is a revision, as JSON or as a multipart/related body with attachments:
+		reader := multipart.NewReader(response.Body, attrs["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			var rev Body
+			partType, partAttrs, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if partType == "multipart/related" {
+				rev, err = ReadMultipartDocument(multipart.NewReader(part, partAttrs["boundary"]))
+			} else {
+				err = ReadJSONFromMIME(http.Header(part.Header), part, &rev)
+			}
+			if err != nil {
+				return nil, err
+			}
+			revs = append(revs, rev)
+		}
+	} else {
+		// CouchDB's JSON format is an array of {"ok": revision} or {"missing": revid}:
+		var results []map[string]interface{}
+		if err := json.NewDecoder(response.Body).Decode(&results); err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			if rev, ok := result["ok"].(map[string]interface{}); ok {
+				revs = append(revs, Body(rev))
+			} else {
+				revs = append(revs, Body(result))
+			}
+		}
+	}
+	return revs, nil
+}
+
+// Saves revisions fetched from the remote into the local database.
+func (r *Replicator) storeRevisions(revs []Body) {
+	for _, rev := range revs {
+		docid, _ := rev["_id"].(string)
+		history := ParseRevisions(rev)
+		if docid == "" || history == nil {
+			r.db.logCtx.Warn("Replicator: Couldn't get revision from <%s>: %v", r.remoteName, rev)
+			r.stats.DocWriteFailures++
+			continue
+		}
+		r.stats.DocsRead++
+		if err := r.db.PutExistingRev(docid, rev, history); err != nil {
+			r.db.logCtx.Warn("Replicator: Couldn't save doc %q rev %s: %v", docid, history[0], err)
+			r.stats.DocWriteFailures++
+		} else {
+			r.db.logCtx.LogTo("Replicate", "\tSaved doc %q rev %s", docid, history[0])
+			r.stats.DocsWritten++
+		}
+	}
+}
+
+//////// PUSHING:
+
+// Gets the local database's changes since the given sequence. If 'wait' is true and there
+// aren't any, waits for a change to arrive (or for the replication to be stopped.)
+func (r *Replicator) getLocalChanges(since string, wait bool) ([]feedChange, error) {
+	options := ChangesOptions{Conflicts: true, DocIDs: r.params.DocIDs}
+	if since != "" {
+		var err error
+		if options.Since, err = strconv.ParseUint(since, 10, 64); err != nil {
+			return nil, &base.HTTPError{http.StatusBadRequest, "Invalid checkpoint sequence " + since}
+		}
+	}
+	chans := channels.SetOf("*")
+	if len(r.params.Channels) > 0 {
+		var err error
+		if chans, err = channels.SetFromArray(r.params.Channels, channels.ExpandStar); err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := r.readLocalChanges(chans, options)
+	if err == nil && len(changes) == 0 && wait {
+		// WaitForRevision can't be canceled, so if the last wait timed out its goroutine is
+		// still waiting, and is reused instead of starting another one.
+		if r.revWaiter == nil {
+			changed := make(chan bool, 1)
+			r.revWaiter = changed
+			go func() {
+				r.db.WaitForRevision()
+				changed <- true
+			}()
+		}
+		select {
+		case <-r.revWaiter:
+			r.revWaiter = nil
+		case <-r.stop:
+			return nil, nil
+		case <-time.After(ReplicationPollInterval):
+		}
+		changes, err = r.readLocalChanges(chans, options)
+	}
+	return changes, err
+}
+
+func (r *Replicator) readLocalChanges(chans channels.Set, options ChangesOptions) ([]feedChange, error) {
+	options.Limit = kReplicationBatchSize
+	feed, err := r.db.MultiChangesFeed(chans, options)
+	if err != nil || feed == nil {
+		return nil, err
+	}
+	changes := []feedChange{}
+	for entry := range feed {
+		changes = append(changes, feedChange{
+			Seq:     json.RawMessage(strconv.FormatUint(entry.Seq, 10)),
+			ID:      entry.ID,
+			Changes: entry.Changes,
+		})
+	}
+	return changes, nil
+}
+
+// Asks the remote which of the changed revisions it's missing, then sends them to it.
+func (r *Replicator) pushRevisions(changes []feedChange) error {
+	input := RevsDiffInput{}
+	for _, change := range changes {
+		for _, rev := range change.Changes {
+			input[change.ID] = append(input[change.ID], rev["rev"])
+			r.stats.MissingChecked++
+		}
+	}
+	var diffs map[string]struct {
+		Missing  []string `json:"missing"`
+		Possible []string `json:"possible_ancestors"`
+	}
+	if _, err := r.sendRequest("POST", "_revs_diff", input, &diffs); err != nil {
+		return err
+	}
+
+	docs := make([]Body, 0, len(diffs))
+	for docid, diff := range diffs {
+		r.stats.MissingFound += len(diff.Missing)
+		attsSince := diff.Possible
+		if attsSince == nil {
+			attsSince = []string{} // send all attachment bodies
+		}
+		for _, revid := range diff.Missing {
+			rev, err := r.db.GetRev(docid, revid, true, attsSince)
+			if err != nil {
+				r.db.logCtx.Warn("Replicator: Couldn't read doc %q rev %s: %v", docid, revid, err)
+				r.stats.DocWriteFailures++
+				continue
+			}
+			r.stats.DocsRead++
+			docs = append(docs, rev)
+		}
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	var results []map[string]interface{}
+	request := Body{"docs": docs, "new_edits": false}
+	if _, err := r.sendRequest("POST", "_bulk_docs", request, &results); err != nil {
+		return err
+	}
+	// (CouchDB's response only lists the docs that failed; Sync Gateway's lists them all.)
+	failures := 0
+	for _, result := range results {
+		if result["error"] != nil {
+			r.db.logCtx.Warn("Replicator: Remote <%s> couldn't save doc %q: %v",
+				r.remoteName, result["id"], result["reason"])
+			failures++
+		}
+	}
+	r.stats.DocWriteFailures += failures
+	r.stats.DocsWritten += len(docs) - failures
+	return nil
+}
+
+//////// HTTP:
+
+// Sends a request with an optional JSON body to the remote database, and parses the JSON
+// response into 'result'. Returns the response's status code.
+func (r *Replicator) sendRequest(method, path string, body interface{}, result interface{}) (int, error) {
+	var input io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		input = bytes.NewReader(data)
+	}
+	rq, err := http.NewRequest(method, r.remote+path, input)
+	if err != nil {
+		return 0, err
+	}
+	rq.Header.Set("Accept", "application/json")
+	if body != nil {
+		rq.Header.Set("Content-Type", "application/json")
+	}
+	response, err := r.send(rq)
+	if err != nil {
+		return 0, err
+	}
+	defer r.endRequest(response)
+	if response.StatusCode >= 300 {
+		return response.StatusCode, &base.HTTPError{response.StatusCode,
+			fmt.Sprintf("%s %s from remote: %s", method, path, response.Status)}
+	}
+	return response.StatusCode, json.NewDecoder(response.Body).Decode(result)
+}
+
+// Sends an HTTP request to the remote. Until the response is closed with endRequest, Stop
+// can cancel it.
+func (r *Replicator) send(rq *http.Request) (*http.Response, error) {
+	r.requestLock.Lock()
+	if r.stopped() {
+		r.requestLock.Unlock()
+		return nil, &base.HTTPError{http.StatusServiceUnavailable, "Replication stopped"}
+	}
+	r.request = rq
+	r.requestLock.Unlock()
+
+	response, err := replicatorClient.Do(rq)
+	if err != nil {
+		r.endRequest(nil)
+	}
+	return response, err
+}
+
+// Closes the response from a request made with send.
+func (r *Replicator) endRequest(response *http.Response) {
+	if response != nil {
+		response.Body.Close()
+	}
+	r.requestLock.Lock()
+	r.request = nil
+	r.requestLock.Unlock()
+}
+
+//////// REPLICATION TASKS:
+
+// Runs a replication as a background task of the local database. It stops when it's caught up
+// (unless it's continuous), or when the task is canceled.
+func (context *DatabaseContext) StartReplication(r *Replicator) (*Task, error) {
+	return context.StartTask("replication", r.id, func(task *Task) error {
+		r.task = task
+		task.OnCancel(r.Stop)
+		r.reportProgress()
+		return r.Run()
+	})
+}
+
+// Stops a replication started by StartReplication, and waits for it to finish.
+func (context *DatabaseContext) StopReplication(id string) error {
+	task := context.getTask("replication-" + id)
+	if task == nil {
+		return &base.HTTPError{http.StatusNotFound, "No such replication is running"}
+	}
+	task.Cancel()
+	task.Wait()
+	return nil
+}
+
+// Updates the replication's task with its current progress.
+func (r *Replicator) reportProgress() {
+	if r.task == nil {
+		return
+	}
+	source, target := r.remoteName, r.db.Name
+	if r.push {
+		source, target = target, source
+	}
+	r.task.SetDetails(Body{
+		"source":             source,
+		"target":             target,
+		"continuous":         r.params.Continuous,
+		"source_last_seq":    r.stats.LastSeq,
+		"missing_checked":    r.stats.MissingChecked,
+		"missing_found":      r.stats.MissingFound,
+		"docs_read":          r.stats.DocsRead,
+		"docs_written":       r.stats.DocsWritten,
+		"doc_write_failures": r.stats.DocWriteFailures,
+	})
+}
@@ -27,6 +27,35 @@ func (body Body) FixJSONNumbers() {
 	}
 }
 
+// Returns a deep copy of a body. Nested maps and arrays are copied; other values are shared.
+func copyBody(body Body) Body {
+	return deepCopyMap(body)
+}
+
+func deepCopyMap(m map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		result[key] = deepCopyValue(value)
+	}
+	return result
+}
+
+func deepCopyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case Body:
+		return Body(deepCopyMap(value))
+	case map[string]interface{}:
+		return deepCopyMap(value)
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, item := range value {
+			result[i] = deepCopyValue(item)
+		}
+		return result
+	}
+	return value
+}
+
 func createRevID(generation int, parentRevID string, body Body) string {
 	// This should produce the same results as TouchDB.
 	digester := md5.New()
@@ -20,10 +20,11 @@ type RevKey string
 
 // Information about a single revision.
 type RevInfo struct {
-	ID      string
-	Parent  string
-	Deleted bool
-	Body    []byte
+	ID        string
+	Parent    string
+	Deleted   bool
+	Compacted bool // If true, Body contains only the revision's attachment metadata
+	Body      []byte
 }
 
 //  A revision tree maps each revision ID to its RevInfo.
@@ -33,10 +34,11 @@ type RevTree map[string]RevInfo
 // rev IDs, with a parallel array of parent indexes. Ordering in the arrays doesn't matter.
 // So the parent of Revs[i] is Revs[Parents[i]] (unless Parents[i] == -1, which denotes a root.)
 type revTreeList struct {
-	Revs    []string `json:"revs"`              // The revision IDs
-	Parents []int    `json:"parents"`           // Index of parent of each revision (-1 if root)
-	Deleted []int    `json:"deleted,omitempty"` // Indexes of revisions that are deletions
-	Bodies  []string `json:"bodies,omitempty"`  // JSON of each revision
+	Revs      []string `json:"revs"`                // The revision IDs
+	Parents   []int    `json:"parents"`             // Index of parent of each revision (-1 if root)
+	Deleted   []int    `json:"deleted,omitempty"`   // Indexes of revisions that are deletions
+	Compacted []int    `json:"compacted,omitempty"` // Indexes of revisions whose bodies were compacted
+	Bodies    []string `json:"bodies,omitempty"`    // JSON of each revision
 }
 
 func (tree RevTree) MarshalJSON() ([]byte, error) {
@@ -59,6 +61,9 @@ func (tree RevTree) MarshalJSON() ([]byte, error) {
 			}
 			rep.Deleted = append(rep.Deleted, i)
 		}
+		if info.Compacted {
+			rep.Compacted = append(rep.Compacted, i)
+		}
 		i++
 	}
 
@@ -98,6 +103,11 @@ func (tree RevTree) UnmarshalJSON(inputjson []byte) (err error) {
 			tree[rep.Revs[i]] = info
 		}
 	}
+	for _, i := range rep.Compacted {
+		info := tree[rep.Revs[i]]
+		info.Compacted = true
+		tree[rep.Revs[i]] = info
+	}
 	return
 }
 
@@ -246,6 +256,96 @@ func (tree RevTree) getParsedRevisionBody(revid string) Body {
 	return body
 }
 
+// Removes old ancestor revisions from the tree: every revision that's more than maxDepth
+// generations away from all of the leaves. (So each leaf keeps maxDepth revisions of history.)
+// The children of removed revisions become roots. Returns the number of revisions removed.
+func (tree RevTree) pruneRevisions(maxDepth uint32) (pruned int) {
+	if len(tree) <= int(maxDepth) {
+		return
+	}
+
+	// Find the minimum depth of each revision below a leaf (leaves have depth 1):
+	minDepths := map[string]uint32{}
+	for _, leaf := range tree.getLeaves() {
+		depth := uint32(1)
+		for revid := leaf; revid != ""; revid = tree[revid].Parent {
+			if d, found := minDepths[revid]; found && d <= depth {
+				break // already visited by a shorter path
+			}
+			minDepths[revid] = depth
+			depth++
+		}
+	}
+
+	for revid, depth := range minDepths {
+		if depth > maxDepth {
+			delete(tree, revid)
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		for revid, info := range tree {
+			if info.Parent != "" && !tree.contains(info.Parent) {
+				info.Parent = ""
+				tree[revid] = info
+			}
+		}
+	}
+	return
+}
+
+// Removes the bodies of non-leaf revisions, which are obsolete. Only their attachment metadata is
+// kept, since a revision added as a child (a new conflict) inherits its parent's attachments.
+// The leaves' bodies are kept, since they're the current revision and any open conflicts.
+// Returns the number of revisions compacted.
+func (tree RevTree) compact() (compacted int) {
+	isParent := map[string]bool{}
+	for _, info := range tree {
+		isParent[info.Parent] = true
+	}
+	for revid, info := range tree {
+		if !isParent[revid] || info.Compacted {
+			continue
+		}
+		var attachments interface{}
+		if len(info.Body) > 0 {
+			var body Body
+			if err := json.Unmarshal(info.Body, &body); err == nil {
+				attachments = body["_attachments"]
+			}
+		}
+		info.Body = nil
+		if attachments != nil {
+			info.Body, _ = json.Marshal(Body{"_attachments": attachments})
+		}
+		info.Compacted = true
+		tree[revid] = info
+		compacted++
+	}
+	return
+}
+
+// Removes the given leaf revisions, along with those of their ancestors that aren't also
+// ancestors of a remaining leaf. Revision IDs that aren't leaves of the tree are ignored.
+// Returns the leaf revision IDs that were removed.
+func (tree RevTree) purgeLeaves(revids []string) (purged []string) {
+	for _, revid := range revids {
+		if !tree.isLeaf(revid) {
+			continue
+		}
+		purged = append(purged, revid)
+		for revid != "" {
+			parent := tree[revid].Parent
+			delete(tree, revid)
+			if !tree.isLeaf(parent) {
+				break // parent has other children (or revid was a root)
+			}
+			revid = parent
+		}
+	}
+	return
+}
+
 // Copies a RevTree.
 func (tree RevTree) copy() RevTree {
 	result := RevTree{}
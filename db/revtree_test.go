@@ -107,6 +107,57 @@ func TestRevTreeWinningRev(t *testing.T) {
 	assert.Equals(t, tempmap.winningRevision(), "3-drei")
 }
 
+func TestRevTreePrune(t *testing.T) {
+	tempmap := branchymap.copy()
+	assert.Equals(t, tempmap.pruneRevisions(3), 0)
+	assert.Equals(t, tempmap.pruneRevisions(2), 1)
+	assert.DeepEquals(t, tempmap, RevTree{"3-three": {ID: "3-three", Parent: "2-two"},
+		"2-two":  {ID: "2-two"},
+		"3-drei": {ID: "3-drei", Parent: "2-two"}})
+
+	// Each branch keeps its own history, even if it's deeper than the longest branch's:
+	tempmap = branchymap.copy()
+	tempmap.addRevision(RevInfo{ID: "4-four", Parent: "3-three"})
+	tempmap.addRevision(RevInfo{ID: "5-five", Parent: "4-four"})
+	assert.Equals(t, tempmap.pruneRevisions(2), 2)
+	leaves := tempmap.getLeaves()
+	sort.Strings(leaves)
+	assert.DeepEquals(t, leaves, []string{"3-drei", "5-five"})
+	assert.DeepEquals(t, tempmap.getHistory("5-five"), []string{"5-five", "4-four"})
+	assert.DeepEquals(t, tempmap.getHistory("3-drei"), []string{"3-drei", "2-two"})
+}
+
+func TestRevTreeCompact(t *testing.T) {
+	tempmap := branchymap.copy()
+	tempmap.setRevisionBody("1-one", []byte(`{"foo":1}`))
+	tempmap.setRevisionBody("2-two", []byte(`{"foo":2,"_attachments":{"a":{"digest":"sha1-x"}}}`))
+	tempmap.setRevisionBody("3-drei", []byte(`{"foo":3}`))
+	assert.Equals(t, tempmap.compact(), 2)
+	assert.Equals(t, tempmap.compact(), 0)
+
+	assertTrue(t, tempmap["1-one"].Compacted, "1-one not compacted")
+	assert.DeepEquals(t, tempmap["1-one"].Body, []byte(nil))
+	assert.Equals(t, string(tempmap["2-two"].Body), `{"_attachments":{"a":{"digest":"sha1-x"}}}`)
+	assertFalse(t, tempmap["3-drei"].Compacted, "leaf was compacted")
+	assert.Equals(t, string(tempmap["3-drei"].Body), `{"foo":3}`)
+
+	// Compaction survives a JSON round trip:
+	bytes, _ := json.Marshal(tempmap)
+	gotmap := RevTree{}
+	assertNoError(t, json.Unmarshal(bytes, &gotmap), "Couldn't parse RevTree from JSON")
+	assert.DeepEquals(t, gotmap, tempmap)
+}
+
+func TestRevTreePurgeLeaves(t *testing.T) {
+	tempmap := branchymap.copy()
+	assert.DeepEquals(t, tempmap.purgeLeaves([]string{"2-two", "9-nine"}), []string(nil))
+	assert.DeepEquals(t, tempmap.purgeLeaves([]string{"3-drei"}), []string{"3-drei"})
+	assert.DeepEquals(t, tempmap.getHistory("3-three"), []string{"3-three", "2-two", "1-one"})
+	assert.Equals(t, len(tempmap), 3)
+	assert.DeepEquals(t, tempmap.purgeLeaves([]string{"3-three"}), []string{"3-three"})
+	assert.Equals(t, len(tempmap), 0)
+}
+
 //////// HELPERS:
 
 func assertFailed(t *testing.T, message string) {
@@ -72,7 +72,12 @@ func (db *Database) putSpecial(doctype string, docid string, matchRev string, bo
 
 	// Ugly hack to detect changes to the channel-mapper function:
 	if err == nil && doctype == "design" && docid == "channels" {
-		db.ReadDesignDocument()
+		if changed, _ := db.readDesignDocument(); changed {
+			// The docs' channels were assigned by the old function, so recompute them:
+			if _, err := db.StartUpdateAllDocChannels(); err != nil {
+				db.logCtx.Warn("Couldn't update doc channels after sync function changed: %v", err)
+			}
+		}
 	}
 
 	return revid, err
@@ -0,0 +1,116 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"time"
+
+	"github.com/couchbaselabs/walrus"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Runtime statistics of a database. Other packages can add their own to the embedded Stats.
+type DatabaseStats struct {
+	*base.Stats
+	DocWrites        *base.Counter
+	DocWriteTime     *base.Histogram
+	CASRetries       *base.Counter
+	SyncFunctionTime *base.Histogram
+	ValidatorTime    *base.Histogram
+	ChangesQueries   *base.Counter
+	BucketOpTime     *base.Histogram
+}
+
+func newDatabaseStats() *DatabaseStats {
+	s := &DatabaseStats{Stats: base.NewStats()}
+	s.DocWrites = s.NewCounter("doc_writes_total", "Number of document revisions saved.")
+	s.DocWriteTime = s.NewHistogram("doc_write_seconds",
+		"Time taken to update a document, including the sync function.")
+	s.CASRetries = s.NewCounter("cas_retries_total",
+		"Number of document updates retried because of a conflicting write (CAS mismatch).")
+	s.SyncFunctionTime = s.NewHistogram("sync_function_seconds",
+		"Time taken to run the JavaScript sync function.")
+	s.ValidatorTime = s.NewHistogram("validator_seconds",
+		"Time taken to run the JavaScript validation function.")
+	s.ChangesQueries = s.NewCounter("changes_queries_total",
+		"Number of queries of the channels view made by changes feeds.")
+	s.BucketOpTime = s.NewHistogram("bucket_op_seconds", "Latency of bucket operations.")
+	return s
+}
+
+// A Bucket that records the latency of its operations in a Histogram.
+type timedBucket struct {
+	base.Bucket
+	opTime *base.Histogram
+}
+
+func (bucket *timedBucket) Get(k string, rv interface{}) error {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.Get(k, rv)
+}
+
+func (bucket *timedBucket) GetRaw(k string) ([]byte, error) {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.GetRaw(k)
+}
+
+func (bucket *timedBucket) Add(k string, exp int, v interface{}) (bool, error) {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.Add(k, exp, v)
+}
+
+func (bucket *timedBucket) AddRaw(k string, exp int, v []byte) (bool, error) {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.AddRaw(k, exp, v)
+}
+
+func (bucket *timedBucket) Set(k string, exp int, v interface{}) error {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.Set(k, exp, v)
+}
+
+func (bucket *timedBucket) SetRaw(k string, exp int, v []byte) error {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.SetRaw(k, exp, v)
+}
+
+func (bucket *timedBucket) Delete(k string) error {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.Delete(k)
+}
+
+func (bucket *timedBucket) Incr(k string, amt, def uint64, exp int) (uint64, error) {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.Incr(k, amt, def, exp)
+}
+
+// The time spent in the callback isn't counted, since it's not the bucket's doing.
+func (bucket *timedBucket) Update(k string, exp int, callback walrus.UpdateFunc) error {
+	start := time.Now()
+	var callbackTime time.Duration
+	err := bucket.Bucket.Update(k, exp, func(current []byte) ([]byte, error) {
+		callbackStart := time.Now()
+		defer func() { callbackTime += time.Since(callbackStart) }()
+		return callback(current)
+	})
+	bucket.opTime.Observe((time.Since(start) - callbackTime).Seconds())
+	return err
+}
+
+func (bucket *timedBucket) View(ddoc, name string, params map[string]interface{}) (walrus.ViewResult, error) {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.View(ddoc, name, params)
+}
+
+func (bucket *timedBucket) ViewCustom(ddoc, name string, params map[string]interface{}, vres interface{}) error {
+	defer bucket.opTime.ObserveSince(time.Now())
+	return bucket.Bucket.ViewCustom(ddoc, name, params, vres)
+}
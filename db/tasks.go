@@ -0,0 +1,207 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// The error returned by a task that stopped because it was canceled.
+var errTaskCanceled = &base.HTTPError{http.StatusServiceUnavailable, "Task was canceled"}
+
+// The function that does the work of a Task. It should call task.SetProgress as it goes, and
+// return errTaskCanceled soon after task.Canceled returns true.
+type TaskFunc func(task *Task) error
+
+// A long-running operation on a database, run in the background by StartTask.
+type Task struct {
+	id        string
+	kind      string
+	database  string
+	startedOn time.Time
+	cancel    chan bool // Closed when the task is canceled
+	finished  chan bool // Closed when the task's function returns
+	err       error     // The task function's result; set before 'finished' is closed
+
+	lock          sync.Mutex
+	updatedOn     time.Time
+	done, total   int
+	details       Body
+	cancelHandler func()
+}
+
+// Runs a function in a goroutine as a task of the database, where it will show up in
+// ActiveTasks and can be canceled. Only one task with a given kind and key can run at once.
+func (context *DatabaseContext) StartTask(kind string, key string, fn TaskFunc) (*Task, error) {
+	now := time.Now()
+	task := &Task{
+		id:        kind + "-" + key,
+		kind:      kind,
+		database:  context.Name,
+		startedOn: now,
+		updatedOn: now,
+		cancel:    make(chan bool),
+		finished:  make(chan bool),
+	}
+
+	context.tasksLock.Lock()
+	defer context.tasksLock.Unlock()
+	if context.tasks[task.id] != nil {
+		return nil, &base.HTTPError{http.StatusConflict, "Task " + task.id + " is already running"}
+	}
+	if context.tasks == nil {
+		context.tasks = map[string]*Task{}
+	}
+	context.tasks[task.id] = task
+
+	base.LogTo("Tasks", "Starting task %s", task.id)
+	go func() {
+		task.err = fn(task)
+		base.LogTo("Tasks", "Finished task %s (err=%v)", task.id, task.err)
+		context.tasksLock.Lock()
+		if context.tasks[task.id] == task {
+			delete(context.tasks, task.id)
+		}
+		context.tasksLock.Unlock()
+		close(task.finished)
+	}()
+	return task, nil
+}
+
+// Returns the database's running tasks, in the order they were started.
+func (context *DatabaseContext) ActiveTasks() []*Task {
+	context.tasksLock.Lock()
+	defer context.tasksLock.Unlock()
+	tasks := make([]*Task, 0, len(context.tasks))
+	for _, task := range context.tasks {
+		tasks = append(tasks, task)
+	}
+	sort.Sort(tasksByStartTime(tasks))
+	return tasks
+}
+
+// Cancels a running task, given its ID. It may take the task a while to notice and stop.
+func (context *DatabaseContext) CancelTask(id string) error {
+	task := context.getTask(id)
+	if task == nil {
+		return &base.HTTPError{http.StatusNotFound, "No such task"}
+	}
+	task.Cancel()
+	return nil
+}
+
+func (context *DatabaseContext) getTask(id string) *Task {
+	context.tasksLock.Lock()
+	defer context.tasksLock.Unlock()
+	return context.tasks[id]
+}
+
+func (context *DatabaseContext) cancelAllTasks() {
+	for _, task := range context.ActiveTasks() {
+		task.Cancel()
+	}
+}
+
+// The task's unique ID.
+func (task *Task) ID() string {
+	return task.id
+}
+
+// Reports how many of the task's units of work (documents, usually) have been done so far.
+func (task *Task) SetProgress(done, total int) {
+	task.lock.Lock()
+	defer task.lock.Unlock()
+	task.done = done
+	task.total = total
+	task.updatedOn = time.Now()
+}
+
+// Sets properties describing the task's state, which will be added to its Info.
+func (task *Task) SetDetails(details Body) {
+	task.lock.Lock()
+	defer task.lock.Unlock()
+	task.details = details
+	task.updatedOn = time.Now()
+}
+
+// Registers a function to be called (once) when the task is canceled, to interrupt it.
+func (task *Task) OnCancel(handler func()) {
+	task.lock.Lock()
+	defer task.lock.Unlock()
+	task.cancelHandler = handler
+	if task.Canceled() {
+		go handler()
+	}
+}
+
+// Tells the task to stop.
+func (task *Task) Cancel() {
+	task.lock.Lock()
+	defer task.lock.Unlock()
+	select {
+	case <-task.cancel:
+		return // already canceled
+	default:
+		close(task.cancel)
+	}
+	if task.cancelHandler != nil {
+		go task.cancelHandler()
+	}
+}
+
+// Returns true if the task has been canceled.
+func (task *Task) Canceled() bool {
+	select {
+	case <-task.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits for the task to finish, and returns its function's result.
+func (task *Task) Wait() error {
+	<-task.finished
+	return task.err
+}
+
+// Describes the task in the format of CouchDB's _active_tasks response.
+func (task *Task) Info() Body {
+	task.lock.Lock()
+	defer task.lock.Unlock()
+	info := Body{}
+	for key, value := range task.details {
+		info[key] = value
+	}
+	info["task_id"] = task.id
+	info["type"] = task.kind
+	info["database"] = task.database
+	info["started_on"] = task.startedOn.Unix()
+	info["updated_on"] = task.updatedOn.Unix()
+	if task.total > 0 {
+		info["changes_done"] = task.done
+		info["total_changes"] = task.total
+		info["progress"] = 100 * task.done / task.total
+	}
+	return info
+}
+
+type tasksByStartTime []*Task
+
+func (tasks tasksByStartTime) Len() int      { return len(tasks) }
+func (tasks tasksByStartTime) Swap(i, j int) { tasks[i], tasks[j] = tasks[j], tasks[i] }
+func (tasks tasksByStartTime) Less(i, j int) bool {
+	return tasks[i].startedOn.Before(tasks[j].startedOn)
+}
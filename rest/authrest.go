@@ -200,61 +200,65 @@ func (h *handler) handleDelDesignDoc() error {
 
 //////// HTTP HANDLER:
 
-func renderError(err error, r http.ResponseWriter) {
-	status, message := base.ErrorAsHTTPStatus(err)
-	r.Header().Set("Content-Type", "application/json")
-	r.WriteHeader(status)
-	jsonOut, _ := json.Marshal(map[string]interface{}{"error": status, "reason": message})
-	r.Write(jsonOut)
-}
-
 type authHandler func(http.ResponseWriter, *http.Request, *auth.Authenticator) error
 
-func handleAuthReq(sc *serverContext, fun authHandler) func(http.ResponseWriter, *http.Request) {
-	return func(r http.ResponseWriter, rq *http.Request) {
-		dbContext := sc.databases[mux.Vars(rq)["db"]]
-		if dbContext == nil {
-			r.WriteHeader(http.StatusNotFound)
-			return
-		}
-		err := fun(r, rq, dbContext.auth)
-		if err != nil {
-			renderError(err, r)
-		}
-	}
+// Runs an authHandler through the usual admin request handling, so it gets a request ID and
+// logging like any other request.
+func handleAuthReq(sc *serverContext, fun authHandler) http.Handler {
+	return makeAdminHandler(sc, func(h *handler) error {
+		return fun(h.response, h.rq, h.authenticator())
+	})
 }
 
 // Starts a simple REST listener that will get and set user credentials.
 func createAuthHandler(sc *serverContext) http.Handler {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/{db}/_session",
+	r.Handle("/{db}/_session",
 		handleAuthReq(sc, createUserSession)).Methods("POST")
 
-	r.HandleFunc("/{db}/user/{name}",
+	r.Handle("/{db}/user/{name}",
 		handleAuthReq(sc, getUserInfo)).Methods("GET", "HEAD")
-	r.HandleFunc("/{db}/user/{name}",
+	r.Handle("/{db}/user/{name}",
 		handleAuthReq(sc, putUser)).Methods("PUT")
-	r.HandleFunc("/{db}/user/{name}",
+	r.Handle("/{db}/user/{name}",
 		handleAuthReq(sc, deleteUser)).Methods("DELETE")
-	r.HandleFunc("/{db}/user",
+	r.Handle("/{db}/user",
 		handleAuthReq(sc, putUser)).Methods("POST")
 
-	r.HandleFunc("/{db}/role/{name}",
+	r.Handle("/{db}/role/{name}",
 		handleAuthReq(sc, getRoleInfo)).Methods("GET", "HEAD")
-	r.HandleFunc("/{db}/role/{name}",
+	r.Handle("/{db}/role/{name}",
 		handleAuthReq(sc, putRole)).Methods("PUT")
-	r.HandleFunc("/{db}/role/{name}",
+	r.Handle("/{db}/role/{name}",
 		handleAuthReq(sc, deleteRole)).Methods("DELETE")
-	r.HandleFunc("/{db}/role",
+	r.Handle("/{db}/role",
 		handleAuthReq(sc, putRole)).Methods("POST")
 
 	// The routes below are part of the CouchDB REST API but should only be available to admins,
 	// so the handlers are moved to the admin port.
+	r.Handle("/_replicate", makeAdminHandler(sc, (*handler).handleReplicate)).Methods("POST")
+	r.Handle("/_active_tasks", makeAdminHandler(sc, (*handler).handleActiveTasks)).Methods("GET", "HEAD")
+	r.Handle("/_active_tasks/{taskid}", makeAdminHandler(sc, (*handler).handleCancelTask)).Methods("DELETE")
+	r.Handle("/_stats", makeAdminHandler(sc, (*handler).handleStats)).Methods("GET", "HEAD")
+	r.Handle("/_metrics", makeAdminHandler(sc, (*handler).handleMetrics)).Methods("GET", "HEAD")
+	r.Handle("/{newdb}/", makeAdminHandler(sc, (*handler).handleCreateDB)).Methods("PUT")
 	r.Handle("/{db}/", makeAdminHandler(sc, (*handler).handleDeleteDB)).Methods("DELETE")
 	dbr := r.PathPrefix("/{db}/").Subrouter()
 	dbr.Handle("/_vacuum",
 		makeAdminHandler(sc, (*handler).handleVacuum)).Methods("POST")
+	dbr.Handle("/_compact",
+		makeAdminHandler(sc, (*handler).handleCompact)).Methods("POST")
+	dbr.Handle("/_compact",
+		makeAdminHandler(sc, (*handler).handleGetCompactStatus)).Methods("GET", "HEAD")
+	dbr.Handle("/_purge",
+		makeAdminHandler(sc, (*handler).handlePurge)).Methods("POST")
+	dbr.Handle("/_purged_infos",
+		makeAdminHandler(sc, (*handler).handleGetPurgedInfos)).Methods("GET", "HEAD")
+	dbr.Handle("/_revs_limit",
+		makeAdminHandler(sc, (*handler).handleGetRevsLimit)).Methods("GET", "HEAD")
+	dbr.Handle("/_revs_limit",
+		makeAdminHandler(sc, (*handler).handlePutRevsLimit)).Methods("PUT")
 	dbr.Handle("/_design/{docid}",
 		makeAdminHandler(sc, (*handler).handleGetDesignDoc)).Methods("GET", "HEAD")
 	dbr.Handle("/_design/{docid}",
@@ -6,9 +6,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sdegutis/go.assert"
 
@@ -20,14 +24,16 @@ func callAuthREST(method, resource string, body string) *httptest.ResponseRecord
 	if err := sc.addDatabase(gTestBucket, "db", false); err != nil {
 		panic(fmt.Sprintf("Error from addDatabase: %v", err))
 	}
-	authHandler := createAuthHandler(sc)
+	return callHandler(createAuthHandler(sc), method, resource, body)
+}
 
+func callHandler(handler http.Handler, method, resource string, body string) *httptest.ResponseRecorder {
 	input := bytes.NewBufferString(body)
 	request, _ := http.NewRequest(method, "http://localhost"+resource, input)
 	response := httptest.NewRecorder()
 	response.Code = 200 // doesn't seem to be initialized by default; filed Go bug #4188
 
-	authHandler.ServeHTTP(response, request)
+	handler.ServeHTTP(response, request)
 	return response
 }
 
@@ -81,6 +87,46 @@ func TestUserAPI(t *testing.T) {
 	json.Unmarshal(response.Body.Bytes(), &body)
 	assert.Equals(t, body["name"], "snej")
 	assertStatus(t, callAuthREST("DELETE", "/db/user/snej", ""), 200)
+
+	// User requests get a request ID like any other:
+	assertStatus(t, callAuthREST("GET", "/nosuchdb/user/snej", ""), 404)
+	response = callAuthREST("GET", "/db/user/GUEST", "")
+	assert.Equals(t, len(response.Header().Get("X-Request-ID")), 16)
+}
+
+func TestAllDocsAsUser(t *testing.T) {
+	bucket, err := db.ConnectToBucket(kTestURL, "default", "alldocs_as_user")
+	assert.Equals(t, err, nil)
+	sc := newServerContext(&ServerConfig{})
+	assert.Equals(t, sc.addDatabase(bucket, "db", false), nil)
+	authHandler := createAuthHandler(sc)
+	publicHandler := createHandler(sc)
+
+	assertStatus(t, callHandler(authHandler, "PUT", "/db/user/alice",
+		`{"password":"letmein", "admin_channels":["public"]}`), 201)
+	database, _ := db.GetDatabase(sc.getDatabase("db").dbcontext, nil)
+	_, err = database.Put("doc1", db.Body{"channels": []string{"public"}})
+	assert.Equals(t, err, nil)
+	_, err = database.Put("doc2", db.Body{"channels": []string{"private"}})
+	assert.Equals(t, err, nil)
+
+	// The user only sees the docs in channels it has access to:
+	request, _ := http.NewRequest("GET", "http://localhost/db/_all_docs", nil)
+	request.SetBasicAuth("alice", "letmein")
+	response := httptest.NewRecorder()
+	publicHandler.ServeHTTP(response, request)
+	assertStatus(t, response, 200)
+	var result struct {
+		Rows []struct{ ID string }
+	}
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, len(result.Rows), 1)
+	assert.Equals(t, result.Rows[0].ID, "doc1")
+
+	request.SetBasicAuth("alice", "wrong")
+	response = httptest.NewRecorder()
+	publicHandler.ServeHTTP(response, request)
+	assertStatus(t, response, 401)
 }
 
 func TestRoleAPI(t *testing.T) {
@@ -112,3 +158,385 @@ func TestRoleAPI(t *testing.T) {
 	assert.Equals(t, body["name"], "hipster")
 	assertStatus(t, callAuthREST("DELETE", "/db/role/hipster", ""), 200)
 }
+
+func TestRevsLimitAPI(t *testing.T) {
+	response := callAuthREST("GET", "/db/_revs_limit", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "1000")
+
+	assertStatus(t, callAuthREST("PUT", "/db/_revs_limit", "50"), 200)
+	assertStatus(t, callAuthREST("PUT", "/db/_revs_limit", "0"), 400)
+	assertStatus(t, callAuthREST("PUT", "/db/_revs_limit", "\"many\""), 400)
+
+	// Only admins can change it:
+	assertStatus(t, callREST("GET", "/db/_revs_limit", ""), 200)
+	assertStatus(t, callREST("PUT", "/db/_revs_limit", "50"), 403)
+}
+
+func TestCompactAPI(t *testing.T) {
+	sc := newServerContext(&ServerConfig{})
+	if err := sc.addDatabase(gTestBucket, "db", false); err != nil {
+		t.Fatalf("Error from addDatabase: %v", err)
+	}
+	authHandler := createAuthHandler(sc)
+
+	assertStatus(t, callHandler(authHandler, "POST", "/db/_compact", ""), 202)
+	var status db.CompactionStatus
+	for i := 0; i < 100; i++ {
+		response := callHandler(authHandler, "GET", "/db/_compact", "")
+		assertStatus(t, response, 200)
+		json.Unmarshal(response.Body.Bytes(), &status)
+		if !status.Running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, status.Running)
+	assert.Equals(t, status.Error, "")
+	assert.True(t, status.DocsProcessed >= status.DocsCompacted)
+
+	// Compaction isn't available through the public API:
+	assertStatus(t, callREST("POST", "/db/_compact", ""), 405)
+}
+
+func TestPurgeAPI(t *testing.T) {
+	revid := createDoc(t, "purgeme")
+	response := callAuthREST("POST", "/db/_purge",
+		`{"purgeme": ["`+revid+`"], "nosuchdoc": ["1-abc"]}`)
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body, db.Body{"purged": map[string]interface{}{
+		"purgeme": []interface{}{revid}}})
+	assertStatus(t, callREST("GET", "/db/purgeme", ""), 404)
+
+	response = callAuthREST("GET", "/db/_purged_infos", "")
+	assertStatus(t, response, 200)
+	var infos struct{ Purged_Infos []db.PurgedInfo }
+	json.Unmarshal(response.Body.Bytes(), &infos)
+	last := infos.Purged_Infos[len(infos.Purged_Infos)-1]
+	assert.Equals(t, last.DocID, "purgeme")
+
+	// Purging isn't available through the public API:
+	assertStatus(t, callREST("POST", "/db/_purge", `{"purgeme": ["*"]}`), 405)
+}
+
+func TestCreateAndDeleteDB(t *testing.T) {
+	file, err := ioutil.TempFile("", "sg_config")
+	assert.Equals(t, err, nil)
+	file.WriteString(`{"adminInterface": ":4985", "log": ["CRUD"], "databases": []}`)
+	file.Close()
+	defer os.Remove(file.Name())
+	serverConfig, err := ReadConfig(file.Name())
+	assert.Equals(t, err, nil)
+	// Simulate settings overridden by command-line flags, which mustn't be saved:
+	addr := ":9999"
+	serverConfig.AdminInterface = &addr
+	serverConfig.Pretty = true
+	sc := newServerContext(serverConfig)
+	authHandler := createAuthHandler(sc)
+	publicHandler := createHandler(sc)
+
+	response := callHandler(authHandler, "PUT", "/tenant/",
+		`{"server": "walrus:", "bucket": "tenant_bucket", "sync": "function(doc){channel(doc.ch);}"}`)
+	assertStatus(t, response, 201)
+	assertStatus(t, callHandler(authHandler, "PUT", "/tenant/", ""), 409)
+	assertStatus(t, callHandler(publicHandler, "PUT", "/other/", ""), 403)
+	assertStatus(t, callHandler(authHandler, "PUT", "/other/", `{"name": "different"}`), 400)
+	assertStatus(t, callHandler(authHandler, "PUT", "/other/", `{"server": "walrus:", "sync": "function(doc{"}`), 400)
+	assertStatus(t, callHandler(authHandler, "PUT", "/Other/", ""), 400)
+
+	response = callHandler(publicHandler, "GET", "/_all_dbs", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), `["tenant"]`)
+	assertStatus(t, callHandler(publicHandler, "PUT", "/tenant/doc1", `{"ch": "x"}`), 201)
+
+	// The new database is saved in the config file:
+	config, err := ReadConfig(file.Name())
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(config.Databases), 1)
+	assert.Equals(t, config.Databases[0].Name, "tenant")
+	assert.Equals(t, *config.Databases[0].Bucket, "tenant_bucket")
+	assert.Equals(t, *config.Databases[0].Sync, "function(doc){channel(doc.ch);}")
+	assert.Equals(t, *config.AdminInterface, ":4985")
+	assert.Equals(t, config.Pretty, false)
+	assert.DeepEquals(t, config.Log, []string{"CRUD"})
+	data, err := ioutil.ReadFile(file.Name())
+	assert.Equals(t, err, nil)
+	assert.False(t, strings.Contains(string(data), `"interface"`))
+
+	// So is a change to its revs_limit:
+	assertStatus(t, callHandler(authHandler, "PUT", "/tenant/_revs_limit", "50"), 200)
+	config, err = ReadConfig(file.Name())
+	assert.Equals(t, err, nil)
+	assert.Equals(t, *config.Databases[0].RevsLimit, uint32(50))
+
+	assertStatus(t, callHandler(publicHandler, "DELETE", "/tenant/", ""), 403)
+	assertStatus(t, callHandler(authHandler, "DELETE", "/tenant/", ""), 200)
+	assertStatus(t, callHandler(publicHandler, "GET", "/tenant/", ""), 404)
+	assertStatus(t, callHandler(authHandler, "DELETE", "/tenant/", ""), 404)
+	config, err = ReadConfig(file.Name())
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(config.Databases), 0)
+
+	// Removing a database leaves its docs, unless delete_docs is given:
+	tenantConfig := `{"server": "walrus:", "bucket": "tenant_bucket"}`
+	assertStatus(t, callHandler(authHandler, "PUT", "/tenant/", tenantConfig), 201)
+	assertStatus(t, callHandler(publicHandler, "GET", "/tenant/doc1", ""), 200)
+	assertStatus(t, callHandler(authHandler, "DELETE", "/tenant/?delete_docs=true", ""), 200)
+	assertStatus(t, callHandler(authHandler, "PUT", "/tenant/", tenantConfig), 201)
+	assertStatus(t, callHandler(publicHandler, "GET", "/tenant/doc1", ""), 404)
+	assertStatus(t, callHandler(authHandler, "DELETE", "/tenant/", ""), 200)
+}
+
+func TestCreateDBSaveFailure(t *testing.T) {
+	// A database whose config can't be saved isn't left running:
+	sc := newServerContext(&ServerConfig{path: "/nonexistent/sg_config.json"})
+	authHandler := createAuthHandler(sc)
+	assertStatus(t, callHandler(authHandler, "PUT", "/tenant/", `{"server": "walrus:"}`), 500)
+	assert.True(t, sc.getDatabase("tenant") == nil)
+	assert.Equals(t, len(sc.config.Databases), 0)
+}
+
+func TestReplicate(t *testing.T) {
+	// Another gateway serves as the remote source database:
+	sourceBucket, err := db.ConnectToBucket(kTestURL, "default", "replicate_source")
+	assert.Equals(t, err, nil)
+	sourceContext := newServerContext(&ServerConfig{})
+	assert.Equals(t, sourceContext.addDatabase(sourceBucket, "source", false), nil)
+	sourceHandler := createHandler(sourceContext)
+	source := httptest.NewServer(sourceHandler)
+	defer source.Close()
+
+	assertStatus(t, callHandler(sourceHandler, "PUT", "/source/rep1", `{"n": 1}`), 201)
+	assertStatus(t, callHandler(sourceHandler, "PUT", "/source/rep2",
+		`{"_attachments": {"hi.txt": {"data": "aGk=", "content_type": "text/plain"}}}`), 201)
+	assertStatus(t, callHandler(sourceHandler, "PUT", "/source/rep3?new_edits=false",
+		`{"n": 3, "_rev": "2-b", "_revisions": {"start": 2, "ids": ["b", "a"]}}`), 201)
+	assertStatus(t, callHandler(sourceHandler, "PUT", "/source/rep3?new_edits=false",
+		`{"n": 4, "_rev": "2-c", "_revisions": {"start": 2, "ids": ["c", "a"]}}`), 201)
+
+	targetBucket, err := db.ConnectToBucket(kTestURL, "default", "replicate_target")
+	assert.Equals(t, err, nil)
+	sc := newServerContext(&ServerConfig{})
+	assert.Equals(t, sc.addDatabase(targetBucket, "target", false), nil)
+	authHandler := createAuthHandler(sc)
+	publicHandler := createHandler(sc)
+
+	request := fmt.Sprintf(`{"source": "%s/source", "target": "target"}`, source.URL)
+	response := callHandler(authHandler, "POST", "/_replicate", request)
+	assertStatus(t, response, 200)
+	var stats db.ReplicationStats
+	json.Unmarshal(response.Body.Bytes(), &stats)
+	assert.Equals(t, stats.MissingFound, 4)
+	assert.Equals(t, stats.DocsWritten, 4)
+	assert.Equals(t, stats.DocWriteFailures, 0)
+
+	response = callHandler(publicHandler, "GET", "/target/rep1", "")
+	assertStatus(t, response, 200)
+	response = callHandler(publicHandler, "GET", "/target/rep2/hi.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "hi")
+	response = callHandler(publicHandler, "GET", "/target/rep3?open_revs=all", "")
+	assertStatus(t, response, 200)
+	assert.True(t, bytes.Contains(response.Body.Bytes(), []byte(`"2-b"`)))
+	assert.True(t, bytes.Contains(response.Body.Bytes(), []byte(`"2-c"`)))
+
+	// Replicating again starts from the checkpoint, so only the new revision is pulled:
+	response = callHandler(sourceHandler, "PUT", "/source/rep4", `{"n": 5}`)
+	assertStatus(t, response, 201)
+	response = callHandler(authHandler, "POST", "/_replicate", request)
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &stats)
+	assert.Equals(t, stats.MissingChecked, 1)
+	assert.Equals(t, stats.DocsWritten, 1)
+
+	// A remote without _bulk_get; revisions are fetched with open_revs instead:
+	noBulkGet := httptest.NewServer(http.HandlerFunc(func(r http.ResponseWriter, rq *http.Request) {
+		if rq.URL.Path == "/source/_bulk_get" {
+			http.NotFound(r, rq)
+			return
+		}
+		sourceHandler.ServeHTTP(r, rq)
+	}))
+	defer noBulkGet.Close()
+	target2Bucket, err := db.ConnectToBucket(kTestURL, "default", "replicate_target2")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, sc.addDatabase(target2Bucket, "target2", false), nil)
+	response = callHandler(authHandler, "POST", "/_replicate", fmt.Sprintf(
+		`{"source": "%s/source", "target": "target2", "doc_ids": ["rep2", "rep3"]}`, noBulkGet.URL))
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &stats)
+	assert.Equals(t, stats.DocsWritten, 3)
+	assert.Equals(t, stats.DocWriteFailures, 0)
+	response = callHandler(publicHandler, "GET", "/target2/rep2/hi.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "hi")
+	assertStatus(t, callHandler(publicHandler, "GET", "/target2/rep1", ""), 404)
+
+	// Continuous replications can be started and cancelled:
+	continuous := fmt.Sprintf(`{"source": "%s/source", "target": "target", "continuous": true}`, source.URL)
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate", continuous), 202)
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate", continuous), 409)
+	assertStatus(t, callHandler(sourceHandler, "PUT", "/source/rep5", `{"n": 6}`), 201)
+	for i := 0; i < 100 && callHandler(publicHandler, "GET", "/target/rep5", "").Code != 200; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertStatus(t, callHandler(publicHandler, "GET", "/target/rep5", ""), 200)
+	cancel := fmt.Sprintf(`{"source": "%s/source", "target": "target", "cancel": true}`, source.URL)
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate", cancel), 202)
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate", cancel), 404)
+	// (The source's longpoll handler doesn't notice the replicator hanging up, so give it a
+	// change to return, or else source.Close would wait for it forever.)
+	assertStatus(t, callHandler(sourceHandler, "PUT", "/source/rep6", `{"n": 7}`), 201)
+
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate",
+		`{"source": "ftp://example.com/db", "target": "target"}`), 400)
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate",
+		`{"source": "http://example.com/db", "target": "target", "channels": ["a"], "doc_ids": ["b"]}`), 400)
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate",
+		`{"source": "http://example.com/db", "target": "nosuchdb"}`), 404)
+}
+
+func TestPushReplicate(t *testing.T) {
+	// Another gateway serves as the remote target database:
+	remoteBucket, err := db.ConnectToBucket(kTestURL, "default", "push_target")
+	assert.Equals(t, err, nil)
+	remoteContext := newServerContext(&ServerConfig{})
+	assert.Equals(t, remoteContext.addDatabase(remoteBucket, "remote", false), nil)
+	remoteHandler := createHandler(remoteContext)
+	remote := httptest.NewServer(remoteHandler)
+	defer remote.Close()
+
+	localBucket, err := db.ConnectToBucket(kTestURL, "default", "push_source")
+	assert.Equals(t, err, nil)
+	sc := newServerContext(&ServerConfig{})
+	assert.Equals(t, sc.addDatabase(localBucket, "local", false), nil)
+	authHandler := createAuthHandler(sc)
+	publicHandler := createHandler(sc)
+
+	assertStatus(t, callHandler(publicHandler, "PUT", "/local/push1", `{"n": 1}`), 201)
+	assertStatus(t, callHandler(publicHandler, "PUT", "/local/push2",
+		`{"_attachments": {"hi.txt": {"data": "aGk=", "content_type": "text/plain"}}}`), 201)
+	assertStatus(t, callHandler(publicHandler, "PUT", "/local/push3?new_edits=false",
+		`{"n": 3, "_rev": "2-b", "_revisions": {"start": 2, "ids": ["b", "a"]}}`), 201)
+	assertStatus(t, callHandler(publicHandler, "PUT", "/local/push3?new_edits=false",
+		`{"n": 4, "_rev": "2-c", "_revisions": {"start": 2, "ids": ["c", "a"]}}`), 201)
+
+	request := fmt.Sprintf(`{"source": "local", "target": "%s/remote"}`, remote.URL)
+	response := callHandler(authHandler, "POST", "/_replicate", request)
+	assertStatus(t, response, 200)
+	var stats db.ReplicationStats
+	json.Unmarshal(response.Body.Bytes(), &stats)
+	assert.Equals(t, stats.MissingFound, 4)
+	assert.Equals(t, stats.DocsWritten, 4)
+	assert.Equals(t, stats.DocWriteFailures, 0)
+
+	assertStatus(t, callHandler(remoteHandler, "GET", "/remote/push1", ""), 200)
+	response = callHandler(remoteHandler, "GET", "/remote/push2/hi.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "hi")
+	response = callHandler(remoteHandler, "GET", "/remote/push3?open_revs=all", "")
+	assertStatus(t, response, 200)
+	assert.True(t, bytes.Contains(response.Body.Bytes(), []byte(`"2-b"`)))
+	assert.True(t, bytes.Contains(response.Body.Bytes(), []byte(`"2-c"`)))
+
+	// Pushing again starts from the checkpoint. The new attachment is sent, and the remote gets
+	// the unchanged one from the previous revision:
+	response = callHandler(publicHandler, "GET", "/local/push2", "")
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assertStatus(t, callHandler(publicHandler, "PUT", "/local/push2/bye.txt?rev="+body["_rev"].(string),
+		"bye"), 201)
+	response = callHandler(authHandler, "POST", "/_replicate", request)
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &stats)
+	assert.Equals(t, stats.MissingChecked, 1)
+	assert.Equals(t, stats.DocsWritten, 1)
+	response = callHandler(remoteHandler, "GET", "/remote/push2/bye.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "bye")
+	response = callHandler(remoteHandler, "GET", "/remote/push2/hi.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "hi")
+
+	// A continuous push sends new changes as they're made:
+	continuous := fmt.Sprintf(`{"source": "local", "target": "%s/remote", "channels": ["*"], "continuous": true}`, remote.URL)
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate", continuous), 202)
+	assertStatus(t, callHandler(publicHandler, "PUT", "/local/push4", `{"n": 5}`), 201)
+	for i := 0; i < 100 && callHandler(remoteHandler, "GET", "/remote/push4", "").Code != 200; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertStatus(t, callHandler(remoteHandler, "GET", "/remote/push4", ""), 200)
+	cancel := fmt.Sprintf(`{"source": "local", "target": "%s/remote", "channels": ["*"], "cancel": true}`, remote.URL)
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate", cancel), 202)
+
+	assertStatus(t, callHandler(authHandler, "POST", "/_replicate",
+		`{"source": "nosuchdb", "target": "http://example.com/db"}`), 404)
+}
+
+func TestActiveTasks(t *testing.T) {
+	sc := newServerContext(&ServerConfig{})
+	assert.Equals(t, sc.addDatabase(gTestBucket, "db", false), nil)
+	authHandler := createAuthHandler(sc)
+
+	response := callHandler(authHandler, "GET", "/_active_tasks", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), `[]`)
+
+	task, err := sc.getDatabase("db").dbcontext.StartTask("test", "db", func(task *db.Task) error {
+		task.SetProgress(5, 10)
+		for !task.Canceled() {
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	})
+	assert.Equals(t, err, nil)
+	response = callHandler(authHandler, "GET", "/_active_tasks", "")
+	assertStatus(t, response, 200)
+	var tasks []db.Body
+	json.Unmarshal(response.Body.Bytes(), &tasks)
+	assert.Equals(t, len(tasks), 1)
+	assert.Equals(t, tasks[0]["task_id"], "test-db")
+	assert.Equals(t, tasks[0]["database"], "db")
+
+	assertStatus(t, callHandler(authHandler, "DELETE", "/_active_tasks/test-db", ""), 200)
+	task.Wait()
+	assertStatus(t, callHandler(authHandler, "DELETE", "/_active_tasks/test-db", ""), 404)
+}
+
+func TestStats(t *testing.T) {
+	sc := newServerContext(&ServerConfig{})
+	assert.Equals(t, sc.addDatabase(gTestBucket, "db", false), nil)
+	publicHandler := createHandler(sc)
+	authHandler := createAuthHandler(sc)
+
+	assertStatus(t, callHandler(publicHandler, "PUT", "/db/statsdoc", `{"n": 1}`), 201)
+	assertStatus(t, callHandler(publicHandler, "GET", "/db/nosuchstatsdoc", ""), 404)
+
+	response := callHandler(authHandler, "GET", "/_stats", "")
+	assertStatus(t, response, 200)
+	var body struct {
+		Server    map[string]interface{}
+		Databases map[string]map[string]interface{}
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	stats := body.Databases["db"]
+	assert.Equals(t, stats["requests_total"], float64(2))
+	assert.Equals(t, stats["request_errors_total"], float64(1))
+	assert.Equals(t, stats["doc_writes_total"], float64(1))
+	assert.Equals(t, stats["changes_feeds"], float64(0))
+	syncTime := stats["sync_function_seconds"].(map[string]interface{})
+	assert.Equals(t, syncTime["count"], float64(1))
+	assert.Equals(t, body.Server["requests_total"], float64(0)) // _stats isn't counted till it's done
+
+	response = callHandler(authHandler, "GET", "/_metrics", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+	text := response.Body.String()
+	assert.True(t, strings.Contains(text, "# TYPE sync_gateway_requests_total counter\n"))
+	assert.True(t, strings.Contains(text, "sync_gateway_requests_total{db=\"db\"} 2\n"))
+	assert.True(t, strings.Contains(text, "sync_gateway_requests_total 1\n"))
+	assert.True(t, strings.Contains(text, "sync_gateway_doc_writes_total{db=\"db\"} 1\n"))
+	assert.True(t, strings.Contains(text, "sync_gateway_sync_function_seconds_count{db=\"db\"} 1\n"))
+}
@@ -71,12 +71,12 @@ func (h *handler) BrowserIDEnabled() bool {
 // Username will be the same as the verified email address. Password will be random.
 // The user will have access to no channels.
 func (h *handler) registerBrowserIDUser(verifiedInfo *BrowserIDResponse) (auth.User, error) {
-	user, err := h.context.auth.NewUser(verifiedInfo.Email, base.GenerateRandomSecret(), channels.Set{})
+	user, err := h.authenticator().NewUser(verifiedInfo.Email, base.GenerateRandomSecret(), channels.Set{})
 	if err != nil {
 		return nil, err
 	}
 	user.SetEmail(verifiedInfo.Email)
-	err = h.context.auth.Save(user)
+	err = h.authenticator().Save(user)
 	if err != nil {
 		return nil, err
 	}
@@ -96,21 +96,21 @@ func (h *handler) handleBrowserIDPOST() error {
 	
 	origin := h.server.config.BrowserID.Origin
 	if origin == "" {
-		base.Warn("Can't accept BrowserID logins: Server URL not configured")
+		h.logCtx.Warn("Can't accept BrowserID logins: Server URL not configured")
 		return &base.HTTPError{http.StatusInternalServerError, "Server url not configured"}
 	}
 
 	// OK, now verify it:
-	base.Log("BrowserID: Verifying assertion %q for %q", params.Assertion, origin)
+	h.logCtx.Log("BrowserID: Verifying assertion %q for %q", params.Assertion, origin)
 	verifiedInfo, err := VerifyBrowserID(params.Assertion, origin)
 	if err != nil {
-		base.Log("BrowserID: Failed verify: %v", err)
+		h.logCtx.Log("BrowserID: Failed verify: %v", err)
 		return err
 	}
-	base.Log("BrowserID: Logged in %q!", verifiedInfo.Email)
+	h.logCtx.Log("BrowserID: Logged in %q!", verifiedInfo.Email)
 
 	// Email is verified. Look up the user and make a login session for her:
-	user, err := h.context.auth.GetUserByEmail(verifiedInfo.Email)
+	user, err := h.authenticator().GetUserByEmail(verifiedInfo.Email)
 	if err != nil {
 		return err
 	}
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
+	"sync"
 
 	"github.com/couchbaselabs/sync_gateway/auth"
 	"github.com/couchbaselabs/sync_gateway/base"
@@ -21,31 +24,56 @@ var DefaultPool = "default"
 
 // JSON object that defines the server configuration.
 type ServerConfig struct {
-	Interface      *string // Interface to bind REST API to, default ":4984"
-	AdminInterface *string // Interface to bind admin API to, default ":4985"
-	BrowserID      *BrowserIDConfig
-	Log            []string // Log keywords to enable
-	Pretty         bool     // Pretty-print JSON responses?
-	Databases      []DbConfig
+	Interface      *string          `json:"interface,omitempty"`      // Interface to bind REST API to, default ":4984"
+	AdminInterface *string          `json:"adminInterface,omitempty"` // Interface to bind admin API to, default ":4985"
+	BrowserID      *BrowserIDConfig `json:"browserid,omitempty"`
+	CORS           *CORSConfig      `json:"CORS,omitempty"`
+	Log            []string         `json:"log,omitempty"`    // Log keywords to enable
+	Pretty         bool             `json:"pretty,omitempty"` // Pretty-print JSON responses?
+	Databases      []DbConfig       `json:"databases"`
+	path           string           // File the config was read from (see serverContext.saveConfig)
 }
 
 // JSON object that defines a database configuration within the ServerConfig.
 type DbConfig struct {
-	Name   string  // Database name in REST API
-	Server *string // Couchbase (or Walrus) server URL, default "http://localhost:8091"
-	Bucket *string // Bucket name on server; defaults to same as 'name'
-	Pool   *string // Couchbase pool name, default "default"
+	Name      string      `json:"name"`                 // Database name in REST API
+	Server    *string     `json:"server,omitempty"`     // Couchbase (or Walrus) server URL, default "http://localhost:8091"
+	Bucket    *string     `json:"bucket,omitempty"`     // Bucket name on server; defaults to same as 'name'
+	Pool      *string     `json:"pool,omitempty"`       // Couchbase pool name, default "default"
+	RevsLimit *uint32     `json:"revs_limit,omitempty"` // Max depth of document revision trees, default 1000
+	Sync      *string     `json:"sync,omitempty"`       // Sync function; overrides the one in the design doc
+	CORS      *CORSConfig `json:"CORS,omitempty"`       // Overrides the server's CORS config
+}
+
+// Cross-Origin Resource Sharing settings, allowing web apps on other origins to use the API.
+type CORSConfig struct {
+	Origin      []string `json:"origin"`                // Allowed origins; "*" allows any
+	Headers     []string `json:"headers,omitempty"`     // Request headers allowed in requests
+	MaxAge      int      `json:"max_age,omitempty"`     // Seconds a preflight response may be cached
+	Credentials bool     `json:"credentials,omitempty"` // Allow cookies and HTTP auth?
+}
+
+func (cors *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range cors.Origin {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
 }
 
 type BrowserIDConfig struct {
-	Origin string // Canonical server URL for BrowserID authentication
+	Origin string `json:"origin"` // Canonical server URL for BrowserID authentication
 }
 
-// Shared context of HTTP handlers. It's important that this remain immutable, because the
-// handlers will access it from multiple goroutines.
+// Shared context of HTTP handlers. Databases can be added and removed while handlers are
+// running, so the database map (and the config) must only be accessed while holding the lock.
 type serverContext struct {
-	config    *ServerConfig
-	databases map[string]*context
+	config       *ServerConfig
+	databases    map[string]*context
+	lock         sync.RWMutex
+	stats        *base.Stats   // Server-wide statistics
+	requestStats *requestStats // Stats of requests not addressed to a database
 }
 
 // Reads a ServerConfig from a JSON file.
@@ -63,9 +91,7 @@ func ReadConfig(path string) (*ServerConfig, error) {
 	}
 
 	// Validation:
-	if len(config.Databases) == 0 {
-		return nil, fmt.Errorf("no databases listed")
-	}
+	config.path = path
 	if config.Interface == nil {
 		config.Interface = &DefaultInterface
 	}
@@ -87,32 +113,88 @@ func ReadConfig(path string) (*ServerConfig, error) {
 }
 
 func newServerContext(config *ServerConfig) *serverContext {
+	stats := base.NewStats()
 	return &serverContext{
-		config:    config,
-		databases: map[string]*context{},
+		config:       config,
+		databases:    map[string]*context{},
+		stats:        stats,
+		requestStats: newRequestStats(stats),
+	}
+}
+
+// Returns the context of the named database, or nil if there isn't one.
+func (sc *serverContext) getDatabase(dbName string) *context {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	return sc.databases[dbName]
+}
+
+// Returns the names of all the databases, sorted.
+func (sc *serverContext) allDatabaseNames() []string {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	names := make([]string, 0, len(sc.databases))
+	for name, _ := range sc.databases {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
 // Adds a database to the serverContext given its Bucket.
 func (sc *serverContext) addDatabase(bucket base.Bucket, dbName string, nag bool) error {
+	c, err := sc.newContext(bucket, DbConfig{Name: dbName}, nag)
+	if err != nil {
+		return err
+	}
+	return sc.registerDatabase(c)
+}
+
+// Makes a database available to handlers.
+func (sc *serverContext) registerDatabase(c *context) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	dbName := c.dbcontext.Name
+	if sc.databases[dbName] != nil {
+		return &base.HTTPError{http.StatusConflict, fmt.Sprintf("Duplicate database name %q", dbName)}
+	}
+	sc.databases[dbName] = c
+	return nil
+}
+
+// Creates the context of a database given its Bucket and configuration, without registering it.
+func (sc *serverContext) newContext(bucket base.Bucket, config DbConfig, nag bool) (*context, error) {
+	dbName := config.Name
 	if dbName == "" {
 		dbName = bucket.GetName()
 	}
 
-	if match, _ := regexp.MatchString(`^[a-z][-a-z0-9_$()+/]*$`, dbName); !match {
-		return fmt.Errorf("Illegal database name: %s", dbName)
+	if err := checkDatabaseName(dbName); err != nil {
+		return nil, err
 	}
-
-	if sc.databases[dbName] != nil {
-		return fmt.Errorf("Duplicate database name %q", dbName)
+	if sc.getDatabase(dbName) != nil {
+		return nil, &base.HTTPError{http.StatusConflict, fmt.Sprintf("Duplicate database name %q", dbName)}
 	}
 
 	dbcontext, err := db.NewDatabaseContext(dbName, bucket)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err := dbcontext.ReadDesignDocument(); err != nil {
-		return err
+		return nil, err
+	}
+	if config.RevsLimit != nil {
+		dbcontext.SetRevsLimit(*config.RevsLimit)
+	}
+	if config.Sync != nil {
+		if dbcontext.ChannelMapper != nil {
+			_, err = dbcontext.ChannelMapper.SetFunction(*config.Sync)
+		} else {
+			dbcontext.ChannelMapper, err = channels.NewChannelMapper(*config.Sync)
+		}
+		if err != nil {
+			return nil, &base.HTTPError{http.StatusBadRequest, fmt.Sprintf("Invalid sync function: %v", err)}
+		}
 	}
 
 	if dbcontext.ChannelMapper == nil {
@@ -128,15 +210,27 @@ func (sc *serverContext) addDatabase(bucket base.Bucket, dbName string, nag bool
 
 	c := &context{
 		dbcontext: dbcontext,
-		auth:      auth.NewAuthenticator(bucket, dbcontext),
+		auth:      auth.NewAuthenticator(dbcontext.Bucket, dbcontext),
+		cors:      config.CORS,
+		stats:     newRequestStats(dbcontext.Stats.Stats),
 	}
+	return c, nil
+}
 
-	sc.databases[dbName] = c
+func checkDatabaseName(dbName string) error {
+	if match, _ := regexp.MatchString(`^[a-z][-a-z0-9_$()+/]*$`, dbName); !match {
+		return &base.HTTPError{http.StatusBadRequest, "Illegal database name: " + dbName}
+	}
 	return nil
 }
 
 // Adds a database to the serverContext given its configuration.
 func (sc *serverContext) addDatabaseFromConfig(config DbConfig) error {
+	if config.Name != "" {
+		if err := checkDatabaseName(config.Name); err != nil {
+			return err
+		}
+	}
 	server := "http://localhost:8091"
 	pool := "default"
 	bucketName := config.Name
@@ -155,7 +249,102 @@ func (sc *serverContext) addDatabaseFromConfig(config DbConfig) error {
 	if err != nil {
 		return err
 	}
-	return sc.addDatabase(bucket, config.Name, true)
+	c, err := sc.newContext(bucket, config, true)
+	if err != nil {
+		return err
+	}
+	if err := sc.registerDatabase(c); err != nil {
+		return err
+	}
+	c.dbcontext.StartExpiry()
+	return nil
+}
+
+// Adds a new database while the server is running, and saves it in the config file.
+func (sc *serverContext) createDatabase(config DbConfig) error {
+	if err := sc.addDatabaseFromConfig(config); err != nil {
+		return err
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.config.Databases = append(sc.config.Databases, config)
+	if err := sc.saveConfig(); err != nil {
+		// Don't leave a database running that won't be there after a restart:
+		sc.config.Databases = sc.config.Databases[:len(sc.config.Databases)-1]
+		if c := sc.databases[config.Name]; c != nil {
+			delete(sc.databases, config.Name)
+			c.dbcontext.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// Removes a database while the server is running, and removes it from the config file.
+// (This doesn't delete any documents.) Returns the removed database's context, which the
+// caller must Close when it's done with it.
+func (sc *serverContext) removeDatabase(dbName string) (*context, error) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	c := sc.databases[dbName]
+	if c == nil {
+		return nil, &base.HTTPError{http.StatusNotFound, "no such database"}
+	}
+	delete(sc.databases, dbName)
+
+	for i, config := range sc.config.Databases {
+		if config.Name == dbName {
+			sc.config.Databases = append(sc.config.Databases[:i], sc.config.Databases[i+1:]...)
+			break
+		}
+	}
+	return c, sc.saveConfig()
+}
+
+// Changes a database's revs_limit, and saves it in the config file.
+func (sc *serverContext) setRevsLimit(dbcontext *db.DatabaseContext, limit uint32) error {
+	dbcontext.SetRevsLimit(limit)
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	for i := range sc.config.Databases {
+		if sc.config.Databases[i].Name == dbcontext.Name {
+			sc.config.Databases[i].RevsLimit = &limit
+			return sc.saveConfig()
+		}
+	}
+	return nil // database isn't in the config, so there's nothing to save
+}
+
+// Writes the config's database list back to the file it was read from, so databases created
+// or removed at runtime will still be there after a restart. Only the file's "databases"
+// property is replaced, since the rest of sc.config may have been overridden by command-line
+// flags. Caller must hold the lock.
+func (sc *serverContext) saveConfig() error {
+	if sc.config.path == "" {
+		base.Warn("Server wasn't started with a config file, so database changes won't persist")
+		return nil
+	}
+	properties := map[string]json.RawMessage{}
+	data, err := ioutil.ReadFile(sc.config.path)
+	if err == nil {
+		if err := json.Unmarshal(data, &properties); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if properties["databases"], err = json.Marshal(sc.config.Databases); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(properties, "", "\t"); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash can't leave a truncated config behind:
+	tempPath := sc.config.path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, sc.config.path)
 }
 
 // Reads the command line flags and the optional config file.
@@ -169,7 +358,7 @@ func ParseCommandLine() *ServerConfig {
 	dbName := flag.String("dbname", "", "Name of CouchDB database (defaults to name of bucket)")
 	pretty := flag.Bool("pretty", false, "Pretty-print JSON responses")
 	verbose := flag.Bool("verbose", false, "Log more info about requests")
-	logKeys := flag.String("log", "", "Log keywords, comma separated")
+	logKeys := flag.String("log", "", "Log keywords, comma separated (\"json\" for JSON output)")
 	flag.Parse()
 
 	var config *ServerConfig
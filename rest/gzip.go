@@ -0,0 +1,119 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Returns true if an Accept-Encoding header value allows a gzipped response, i.e. it lists
+// "gzip" (or "*", if gzip isn't listed) without a q-value of 0.
+func acceptsGzip(acceptEncoding string) bool {
+	accepts := false
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		if coding != "*" {
+			return q > 0 // an explicit gzip entry overrides "*"
+		}
+		accepts = q > 0
+	}
+	return accepts
+}
+
+// An http.ResponseWriter that gzips the response body, if its content type is worth compressing.
+// The decision is made when the status is written, so the handler has to set the Content-Type
+// before writing the body. (Handlers that need the raw body, like attachment ranges, should
+// call handler.disableCompression.)
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func newGzipResponseWriter(response http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: response}
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.decided = true
+		header := w.Header()
+		if status >= 200 && status < 300 && status != http.StatusNoContent &&
+			header.Get("Content-Encoding") == "" && isCompressible(header.Get("Content-Type")) {
+			header.Del("Content-Length") // it's the length of the uncompressed body
+			header.Set("Content-Encoding", "gzip")
+			header.Add("Vary", "Accept-Encoding")
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Sends everything written so far to the client; used by continuous feeds.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Allows a WebSocket to take over the connection.
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("ResponseWriter doesn't support Hijack")
+}
+
+// Writes the end of the gzip stream. Must be called after the handler finishes.
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+func isCompressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json") ||
+		strings.HasPrefix(contentType, "multipart/") ||
+		strings.HasPrefix(contentType, "text/")
+}
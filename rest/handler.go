@@ -11,6 +11,7 @@ package rest
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -19,6 +20,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -43,6 +45,7 @@ type handler struct {
 	db       *db.Database
 	user     auth.User
 	admin    bool
+	logCtx   *base.LogContext // Tags log messages with the request ID, database and user
 }
 
 type handlerMethod func(*handler) error
@@ -58,6 +61,7 @@ func makeAdminHandler(server *serverContext, method handlerMethod) http.Handler
 		}
 		err := h.invoke(method)
 		h.writeError(err)
+		h.finishResponse()
 	})
 }
 
@@ -72,12 +76,50 @@ func makeHandler(server *serverContext, method handlerMethod) http.Handler {
 		}
 		err := h.invoke(method)
 		h.writeError(err)
+		h.finishResponse()
 	})
 }
 
-func (h *handler) invoke(method handlerMethod) error {
-	base.LogTo("HTTP", "%s %s", h.rq.Method, h.rq.URL)
+func (h *handler) invoke(method handlerMethod) (err error) {
+	start := time.Now()
+	defer func() { h.recordRequest(start, err) }()
+
+	// Identify the request in log messages by the client's X-Request-ID, or else a random one:
+	h.logCtx = &base.LogContext{
+		RequestID: h.rq.Header.Get("X-Request-ID"),
+		Database:  h.PathVars()["db"],
+	}
+	if h.logCtx.RequestID == "" {
+		h.logCtx.RequestID = base.CreateRequestID()
+	}
+	h.logCtx.LogTo("HTTP", "%s %s", h.rq.Method, h.rq.URL)
 	h.setHeader("Server", VersionString)
+	h.setHeader("X-Request-ID", h.logCtx.RequestID)
+	if h.rq.Method != "OPTIONS" {
+		h.addCORSHeaders(h.PathVars()["db"]) // (preflight requests are handled by handleOptions)
+	}
+
+	// Transparently decode gzipped request bodies, and compress responses if the client accepts it:
+	if h.rq.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(h.rq.Body)
+		if err != nil {
+			return &base.HTTPError{http.StatusBadRequest, "Invalid gzip request body"}
+		}
+		h.rq.Body = reader
+		h.rq.Header.Del("Content-Encoding")
+	}
+	if acceptsGzip(h.rq.Header.Get("Accept-Encoding")) {
+		h.response = newGzipResponseWriter(h.response)
+	}
+
+	// If there is a "db" path variable, look up the database (before authenticating, since
+	// the user is looked up in the database's authenticator):
+	dbname, hasDB := h.PathVars()["db"]
+	if hasDB {
+		if h.context = h.server.getDatabase(dbname); h.context == nil {
+			return &base.HTTPError{http.StatusNotFound, "no such database"}
+		}
+	}
 
 	// Authenticate all paths other than "/_session":
 	path := h.rq.URL.Path
@@ -87,18 +129,12 @@ func (h *handler) invoke(method handlerMethod) error {
 		}
 	}
 
-	// If there is a "db" path variable, look up the database:
-	if dbname, ok := h.PathVars()["db"]; ok {
+	if hasDB {
 		var err error
-		h.context = h.server.databases[dbname]
-		if h.context != nil {
-			h.db, err = db.GetDatabase(h.context.dbcontext, h.user)
-		} else {
-			err = &base.HTTPError{http.StatusNotFound, "no such database"}
-		}
-		if err != nil {
+		if h.db, err = db.GetDatabase(h.context.dbcontext, h.user); err != nil {
 			return err
 		}
+		h.db.SetLogContext(h.logCtx)
 	}
 
 	return method(h) // Call the actual handler code
@@ -112,25 +148,58 @@ func (h *handler) checkAuth() error {
 
 	// Check cookie first, then HTTP auth:
 	var err error
-	h.user, err = h.context.auth.AuthenticateCookie(h.rq)
+	h.user, err = h.authenticator().AuthenticateCookie(h.rq)
 	if err != nil {
 		return err
 	}
 	var userName, password string
 	if h.user == nil {
 		userName, password = h.getBasicAuth()
-		h.user = h.context.auth.AuthenticateUser(userName, password)
+		h.user = h.authenticator().AuthenticateUser(userName, password)
 	}
 
 	if h.user == nil {
 		cookie, _ := h.rq.Cookie(auth.CookieName)
-		base.Log("Auth failed for username=%q, cookie=%q", userName, cookie)
+		h.logCtx.Log("Auth failed for username=%q, cookie=%q", userName, cookie)
 		h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway"`)
 		return &base.HTTPError{http.StatusUnauthorized, "Invalid login"}
 	}
+	h.logCtx.User = h.user.Name()
 	return nil
 }
 
+// Returns the database's Authenticator, set up to tag its log messages with the request's.
+func (h *handler) authenticator() *auth.Authenticator {
+	return h.context.auth.WithLogContext(h.logCtx)
+}
+
+// Returns the CORS configuration that applies to a database (or the server, if dbName is "".)
+func (h *handler) corsConfig(dbName string) *CORSConfig {
+	if dbName != "" {
+		if c := h.server.getDatabase(dbName); c != nil && c.cors != nil {
+			return c.cors
+		}
+	}
+	return h.server.config.CORS
+}
+
+// Adds CORS headers to the response if the request comes from an allowed origin.
+// Returns the CORS config if the origin is allowed, else nil.
+func (h *handler) addCORSHeaders(dbName string) *CORSConfig {
+	origin := h.rq.Header.Get("Origin")
+	cors := h.corsConfig(dbName)
+	if origin == "" || cors == nil || !cors.allowsOrigin(origin) {
+		return nil
+	}
+	header := h.response.Header()
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Add("Vary", "Origin")
+	if cors.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	return cors
+}
+
 func (h *handler) PathVars() map[string]string {
 	return mux.Vars(h.rq)
 }
@@ -153,12 +222,118 @@ func (h *handler) getIntQuery(query string, defaultValue uint64) (value uint64)
 	return
 }
 
+// Returns the value of a URL query that's encoded as a JSON string, like "startkey" in a
+// view query. Returns "" if the query is missing.
+func (h *handler) getJSONStringQuery(query string) (value string, err error) {
+	if q := h.getQuery(query); q != "" {
+		if json.Unmarshal([]byte(q), &value) != nil {
+			err = &base.HTTPError{http.StatusBadRequest, "Invalid JSON string in " + query}
+		}
+	}
+	return
+}
+
+// An entity tag from an If-Match or If-None-Match header.
+type etag struct {
+	value string // The tag without its quotes, or "*"
+	weak  bool   // True if it had a "W/" prefix
+}
+
+// Parses the value of an If-Match or If-None-Match header: a comma-separated list of entity tags.
+// (Unquoted tags are accepted too, for compatibility with lax clients.)
+func parseEtags(header string) ([]etag, error) {
+	var tags []etag
+	header = strings.TrimSpace(header)
+	for header != "" {
+		var tag etag
+		if strings.HasPrefix(header, "W/") {
+			tag.weak = true
+			header = header[2:]
+		}
+		if strings.HasPrefix(header, `"`) {
+			end := strings.Index(header[1:], `"`)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated entity tag")
+			}
+			tag.value = header[1 : end+1]
+			header = header[end+2:]
+		} else {
+			end := strings.Index(header, ",")
+			if end < 0 {
+				end = len(header)
+			}
+			tag.value = strings.TrimSpace(header[:end])
+			header = header[end:]
+		}
+		if tag.value == "" {
+			return nil, fmt.Errorf("empty entity tag")
+		}
+		tags = append(tags, tag)
+
+		header = strings.TrimSpace(header)
+		if header != "" {
+			if header[0] != ',' {
+				return nil, fmt.Errorf("missing comma between entity tags")
+			}
+			header = strings.TrimSpace(header[1:])
+		}
+	}
+	return tags, nil
+}
+
+// Returns the revision ID given by the If-Match header, or "" if there isn't one. Since it's
+// used as the parent revision of an update, it has to be a single strong entity tag.
+func (h *handler) getIfMatch() (string, error) {
+	tags, err := parseEtags(h.rq.Header.Get("If-Match"))
+	if err != nil || len(tags) > 1 || (len(tags) == 1 && (tags[0].weak || tags[0].value == "*")) {
+		return "", &base.HTTPError{http.StatusBadRequest, "Invalid If-Match"}
+	} else if len(tags) == 0 {
+		return "", nil
+	}
+	return tags[0].value, nil
+}
+
+// Returns true if the If-None-Match header matches the revision ID, i.e. the client already
+// has that revision. Uses weak comparison, and "*" matches any revision.
+func (h *handler) ifNoneMatch(revid string) (bool, error) {
+	tags, err := parseEtags(h.rq.Header.Get("If-None-Match"))
+	if err != nil {
+		return false, &base.HTTPError{http.StatusBadRequest, "Invalid If-None-Match"}
+	}
+	for _, tag := range tags {
+		if tag.value == "*" || tag.value == revid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the revision ID given by the "rev" query or the If-Match header.
+func (h *handler) getRevID() (revid string, err error) {
+	revid = h.getQuery("rev")
+	ifMatch, err := h.getIfMatch()
+	if err != nil {
+		return
+	}
+	if revid == "" {
+		revid = ifMatch
+	} else if ifMatch != "" && ifMatch != revid {
+		err = &base.HTTPError{http.StatusBadRequest, "Revision IDs provided do not match"}
+	}
+	return
+}
+
 // Parses a JSON request body, returning it as a Body map.
 func (h *handler) readJSON() (db.Body, error) {
 	var body db.Body
 	return body, db.ReadJSONFromMIME(h.rq.Header, h.rq.Body, &body)
 }
 
+// Parses a JSON request body into a struct (or other value).
+func (h *handler) readJSONInto(into interface{}) error {
+	return db.ReadJSONFromMIME(h.rq.Header, h.rq.Body, into)
+}
+
 func (h *handler) readDocument() (db.Body, error) {
 	contentType, attrs, _ := mime.ParseMediaType(h.rq.Header.Get("Content-Type"))
 	switch contentType {
@@ -192,26 +367,45 @@ func (h *handler) getBasicAuth() (username string, password string) {
 
 //////// RESPONSES:
 
+// Turns off gzip compression of the response, for handlers that need to write the raw body.
+func (h *handler) disableCompression() {
+	if gz, ok := h.response.(*gzipResponseWriter); ok {
+		h.response = gz.ResponseWriter
+	}
+}
+
+// Called after the handler method returns, to flush any buffered (compressed) output.
+func (h *handler) finishResponse() {
+	if gz, ok := h.response.(*gzipResponseWriter); ok {
+		gz.Close()
+	}
+}
+
 func (h *handler) setHeader(name string, value string) {
 	h.response.Header().Set(name, value)
 }
 
+// Sets the Etag header to a revision ID or digest, quoting it as HTTP requires.
+func (h *handler) setEtag(etag string) {
+	h.setHeader("Etag", strconv.Quote(etag))
+}
+
 func (h *handler) logStatus(status int, message string) {
-	base.LogTo("HTTP+", "    --> %d %s", status, message)
+	h.logCtx.LogTo("HTTP+", "    --> %d %s", status, message)
 }
 
 // Writes an object to the response in JSON format.
 // If status is nonzero, the header will be written with that status.
 func (h *handler) writeJSONStatus(status int, value interface{}) {
 	if !h.requestAccepts("application/json") {
-		base.Warn("Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
+		h.logCtx.Warn("Client won't accept JSON, only %s", h.rq.Header.Get("Accept"))
 		h.writeStatus(http.StatusNotAcceptable, "only application/json available")
 		return
 	}
 
 	jsonOut, err := json.Marshal(value)
 	if err != nil {
-		base.Warn("Couldn't serialize JSON for %v", value)
+		h.logCtx.Warn("Couldn't serialize JSON for %v", value)
 		h.writeStatus(http.StatusInternalServerError, "JSON serialization failed")
 		return
 	}
@@ -238,14 +432,16 @@ func (h *handler) writeJSON(value interface{}) {
 	h.writeJSONStatus(http.StatusOK, value)
 }
 
-func (h *handler) writeMultipart(callback func(*multipart.Writer) error) error {
+// Writes a MIME multipart response of the given subtype ("related", "mixed"...), whose parts are
+// generated by the callback.
+func (h *handler) writeMultipart(subtype string, callback func(*multipart.Writer) error) error {
 	if !h.requestAccepts("multipart/") {
 		return &base.HTTPError{Status: http.StatusNotAcceptable}
 	}
 	var buffer bytes.Buffer
 	writer := multipart.NewWriter(&buffer)
 	h.setHeader("Content-Type",
-		fmt.Sprintf("multipart/related; boundary=%q", writer.Boundary()))
+		fmt.Sprintf("multipart/%s; boundary=%q", subtype, writer.Boundary()))
 
 	err := callback(writer)
 	writer.Close()
@@ -293,7 +489,7 @@ func (h *handler) writeError(err error) {
 
 // Writes the response status code, and if it's an error writes a JSON description to the body.
 func (h *handler) writeStatus(status int, message string) {
-	if status < 300 {
+	if status < 300 || status == http.StatusNotModified {
 		h.response.WriteHeader(status)
 		h.logStatus(status, message)
 		return
@@ -314,7 +510,7 @@ func (h *handler) writeStatus(status int, message string) {
 
 	h.setHeader("Content-Type", "application/json")
 	h.response.WriteHeader(status)
-	base.LogTo("HTTP", "    --> %d %s", status, message)
+	h.logCtx.LogTo("HTTP", "    --> %d %s", status, message)
 	jsonOut, _ := json.Marshal(db.Body{"error": errorStr, "reason": message})
 	h.response.Write(jsonOut)
 }
@@ -10,11 +10,16 @@
 package rest
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +36,8 @@ const VersionString = "Couchbase Sync Gateway/0.3"
 type context struct {
 	dbcontext *db.DatabaseContext
 	auth      *auth.Authenticator
+	cors      *CORSConfig   // overrides the server's CORS config, if non-nil
+	stats     *requestStats // stored in dbcontext.Stats
 }
 
 // HTTP handler for a GET of a document
@@ -63,40 +70,55 @@ func (h *handler) handleGetDoc() error {
 		if value == nil {
 			return kNotFoundError
 		}
-		h.setHeader("Etag", value["_rev"].(string))
+		revid = value["_rev"].(string)
+		h.setEtag(revid)
+		if match, err := h.ifNoneMatch(revid); err != nil {
+			return err
+		} else if match {
+			h.writeStatus(http.StatusNotModified, "Not Modified")
+			return nil
+		}
 
 		if h.requestAccepts("application/json") {
 			h.writeJSON(value)
 		} else {
-			return h.writeMultipart(func(writer *multipart.Writer) error {
+			return h.writeMultipart("related", func(writer *multipart.Writer) error {
 				h.db.WriteMultipartDocument(value, writer)
 				return nil
 			})
 		}
 
-	} else if openRevs == "all" {
-		return &base.HTTPError{http.StatusNotImplemented, "open_revs=all unimplemented"} // TODO
-
 	} else {
 		var revids []string
-		err := json.Unmarshal([]byte(openRevs), &revids)
-		if err != nil {
-			return &base.HTTPError{http.StatusBadRequest, "bad open_revs"}
+		if openRevs == "all" {
+			var err error
+			revids, err = h.db.GetLeafRevIDs(docid)
+			if err != nil {
+				return err
+			}
+		} else {
+			err := json.Unmarshal([]byte(openRevs), &revids)
+			if err != nil {
+				return &base.HTTPError{http.StatusBadRequest, "bad open_revs"}
+			}
 		}
 
-		err = h.writeMultipart(func(writer *multipart.Writer) error {
+		err := h.writeMultipart("mixed", func(writer *multipart.Writer) error {
 			for _, revid := range revids {
 				contentType := "application/json"
 				value, err := h.db.GetRev(docid, revid, includeRevs, attachmentsSince)
 				if err != nil {
-					value = db.Body{"missing": revid} //TODO: More specific error
+					if status, _ := base.ErrorAsHTTPStatus(err); status != http.StatusNotFound {
+						return err
+					}
+					value = db.Body{"missing": revid}
 					contentType += `; error="true"`
+				} else if attachmentsSince != nil && len(db.BodyAttachments(value)) > 0 {
+					// Revision has attachment bodies, so send it as a nested multipart/related:
+					h.writeRelatedPart(value, writer)
+					continue
 				}
-				jsonOut, _ := json.Marshal(value)
-				partHeaders := textproto.MIMEHeader{}
-				partHeaders.Set("Content-Type", contentType)
-				part, _ := writer.CreatePart(partHeaders)
-				part.Write(jsonOut)
+				writeJSONPart(writer, contentType, value)
 			}
 			return nil
 		})
@@ -105,6 +127,29 @@ func (h *handler) handleGetDoc() error {
 	return nil
 }
 
+// Writes a JSON value as a part of a multipart writer.
+func writeJSONPart(writer *multipart.Writer, contentType string, value interface{}) {
+	jsonOut, _ := json.Marshal(value)
+	partHeaders := textproto.MIMEHeader{}
+	partHeaders.Set("Content-Type", contentType)
+	part, _ := writer.CreatePart(partHeaders)
+	part.Write(jsonOut)
+}
+
+// Writes a revision as a multipart/related body nested in a part of a multipart writer.
+func (h *handler) writeRelatedPart(body db.Body, writer *multipart.Writer) {
+	var buffer bytes.Buffer
+	relatedWriter := multipart.NewWriter(&buffer)
+	h.db.WriteMultipartDocument(body, relatedWriter)
+	relatedWriter.Close()
+
+	partHeaders := textproto.MIMEHeader{}
+	partHeaders.Set("Content-Type",
+		fmt.Sprintf("multipart/related; boundary=%q", relatedWriter.Boundary()))
+	part, _ := writer.CreatePart(partHeaders)
+	part.Write(buffer.Bytes())
+}
+
 // HTTP handler for a PUT of a document
 func (h *handler) handlePutDoc() error {
 	docid := h.PathVars()["docid"]
@@ -115,12 +160,21 @@ func (h *handler) handlePutDoc() error {
 	var newRev string
 
 	if h.getQuery("new_edits") != "false" {
-		// Regular PUT:
+		// Regular PUT. The parent revision may be given by If-Match instead of "_rev":
+		if ifMatch, err := h.getIfMatch(); err != nil {
+			return err
+		} else if ifMatch != "" {
+			if revid, _ := body["_rev"].(string); revid == "" {
+				body["_rev"] = ifMatch
+			} else if revid != ifMatch {
+				return &base.HTTPError{http.StatusBadRequest, "Revision IDs provided do not match"}
+			}
+		}
 		newRev, err = h.db.Put(docid, body)
 		if err != nil {
 			return err
 		}
-		h.setHeader("Etag", newRev)
+		h.setEtag(newRev)
 	} else {
 		// Replicator-style PUT with new_edits=false:
 		revisions := db.ParseRevisions(body)
@@ -148,7 +202,7 @@ func (h *handler) handlePostDoc() error {
 		return err
 	}
 	h.setHeader("Location", docid)
-	h.setHeader("Etag", newRev)
+	h.setEtag(newRev)
 	h.writeJSON(db.Body{"ok": true, "id": docid, "rev": newRev})
 	return nil
 }
@@ -156,7 +210,10 @@ func (h *handler) handlePostDoc() error {
 // HTTP handler for a DELETE of a document
 func (h *handler) handleDeleteDoc() error {
 	docid := h.PathVars()["docid"]
-	revid := h.getQuery("rev")
+	revid, err := h.getRevID()
+	if err != nil {
+		return err
+	}
 	newRev, err := h.db.DeleteDoc(docid, revid)
 	if err == nil {
 		h.writeJSON(db.Body{"ok": true, "id": docid, "rev": newRev})
@@ -164,66 +221,110 @@ func (h *handler) handleDeleteDoc() error {
 	return err
 }
 
+// HTTP handler for a COPY of a document. The destination doc ID (and its current rev, if it
+// exists) are given in the Destination header, like "docid?rev=1-xxx".
+func (h *handler) handleCopyDoc() error {
+	docid := h.PathVars()["docid"]
+	// (Not parsed as a URL, since a doc ID like "user:1" would look like a URL scheme.)
+	destination := strings.SplitN(h.rq.Header.Get("Destination"), "?", 2)
+	dstDocID, err := url.PathUnescape(destination[0])
+	if err != nil || dstDocID == "" {
+		return &base.HTTPError{http.StatusBadRequest, "Missing or invalid Destination header"}
+	}
+	dstRevID := ""
+	if len(destination) > 1 {
+		query, err := url.ParseQuery(destination[1])
+		if err != nil {
+			return &base.HTTPError{http.StatusBadRequest, "Invalid Destination header"}
+		}
+		dstRevID = query.Get("rev")
+	}
+	newRev, err := h.db.CopyDoc(docid, h.getQuery("rev"), dstDocID, dstRevID)
+	if err != nil {
+		return err
+	}
+	h.setEtag(newRev)
+	h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true, "id": dstDocID, "rev": newRev})
+	return nil
+}
+
 // HTTP handler for _all_docs
 func (h *handler) handleAllDocs() error {
 	// http://wiki.apache.org/couchdb/HTTP_Bulk_Document_API
 	includeDocs := h.getBoolQuery("include_docs")
 	includeRevs := h.getBoolQuery("revs")
-	var ids []db.IDAndRev
+	var options db.AllDocsOptions
+	options.IncludeChannels = h.getBoolQuery("channels")
 	var err error
 
 	// Get the doc IDs:
 	if h.rq.Method == "GET" || h.rq.Method == "HEAD" {
-		ids, err = h.db.AllDocIDs()
+		if options.StartKey, err = h.getJSONStringQuery("startkey"); err != nil {
+			return err
+		}
+		if options.EndKey, err = h.getJSONStringQuery("endkey"); err != nil {
+			return err
+		}
+		options.ExcludeEnd = (h.getQuery("inclusive_end") == "false")
+		options.Limit = int(h.getIntQuery("limit", 0))
+		options.Skip = int(h.getIntQuery("skip", 0))
+		options.Descending = h.getBoolQuery("descending")
 	} else {
 		input, err := h.readJSON()
-		if err == nil {
-			keys, ok := input["keys"].([]interface{})
-			ids = make([]db.IDAndRev, len(keys))
-			for i := 0; i < len(keys); i++ {
-				ids[i].DocID, ok = keys[i].(string)
-				if !ok {
-					break
-				}
-			}
+		if err != nil {
+			return err
+		}
+		keys, ok := input["keys"].([]interface{})
+		options.Keys = make([]string, len(keys))
+		for i := 0; i < len(keys); i++ {
+			options.Keys[i], ok = keys[i].(string)
 			if !ok {
-				err = &base.HTTPError{http.StatusBadRequest, "Bad/missing keys"}
+				break
 			}
 		}
+		if !ok {
+			return &base.HTTPError{http.StatusBadRequest, "Bad/missing keys"}
+		}
 	}
+	allDocs, err := h.db.QueryAllDocIDs(options)
 	if err != nil {
 		return err
 	}
 
 	type viewRow struct {
-		ID    string            `json:"id"`
-		Key   string            `json:"key"`
-		Value map[string]string `json:"value"`
-		Doc   db.Body           `json:"doc,omitempty"`
+		ID    string                 `json:"id"`
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+		Doc   db.Body                `json:"doc,omitempty"`
 	}
 	type viewResult struct {
 		TotalRows int       `json:"total_rows"`
 		Offset    int       `json:"offset"`
+		UpdateSeq *uint64   `json:"update_seq,omitempty"`
 		Rows      []viewRow `json:"rows"`
 	}
 
 	// Assemble the result (and read docs if includeDocs is set)
-	result := viewResult{TotalRows: len(ids), Rows: make([]viewRow, 0, len(ids))}
-	for _, id := range ids {
+	result := viewResult{TotalRows: allDocs.TotalRows, Offset: allDocs.Offset,
+		Rows: make([]viewRow, 0, len(allDocs.Rows))}
+	if h.getBoolQuery("update_seq") {
+		lastSeq, _ := h.db.LastSequence()
+		result.UpdateSeq = &lastSeq
+	}
+	for _, id := range allDocs.Rows {
 		row := viewRow{ID: id.DocID, Key: id.DocID}
-		if includeDocs || id.RevID == "" {
+		if includeDocs {
 			// Fetch the document body:
 			body, err := h.db.GetRev(id.DocID, id.RevID, includeRevs, nil)
-			if err == nil {
-				id.RevID = body["_rev"].(string)
-				if includeDocs {
-					row.Doc = body
-				}
-			} else {
+			if err != nil {
 				continue
 			}
+			row.Doc = body
+		}
+		row.Value = map[string]interface{}{"rev": id.RevID}
+		if options.IncludeChannels {
+			row.Value["channels"] = id.Channels
 		}
-		row.Value = map[string]string{"rev": id.RevID}
 		result.Rows = append(result.Rows, row)
 	}
 
@@ -285,13 +386,38 @@ func (h *handler) handleBulkGet() error {
 		result = append(result, body)
 	}
 
-	h.writeJSONStatus(http.StatusOK, result)
-	return nil
+	if !strings.Contains(h.rq.Header.Get("Accept"), "multipart/mixed") {
+		h.writeJSONStatus(http.StatusOK, result)
+		return nil
+	}
+
+	// Multipart response: each revision is a part, and ones with attachments are multipart/related
+	// parts in which large attachments follow the JSON as binary parts.
+	return h.writeMultipart("mixed", func(writer *multipart.Writer) error {
+		for _, body := range result {
+			if body["_rev"] == nil { // it's an error, not a revision
+				writeJSONPart(writer, `application/json; error="true"`, body)
+			} else if includeAttachments && len(db.BodyAttachments(body)) > 0 {
+				h.writeRelatedPart(body, writer)
+			} else {
+				writeJSONPart(writer, "application/json", body)
+			}
+		}
+		return nil
+	})
 }
 
 // HTTP handler for a POST to _bulk_docs
 func (h *handler) handleBulkDocs() error {
-	body, err := h.readJSON()
+	// The request may be multipart, with attachment bodies following the JSON:
+	var body db.Body
+	var err error
+	contentType, attrs, _ := mime.ParseMediaType(h.rq.Header.Get("Content-Type"))
+	if contentType == "multipart/related" {
+		body, err = h.db.ReadMultipartBulkDocs(multipart.NewReader(h.rq.Body, attrs["boundary"]))
+	} else {
+		body, err = h.readJSON()
+	}
 	if err != nil {
 		return err
 	}
@@ -303,6 +429,10 @@ func (h *handler) handleBulkDocs() error {
 	docs := body["docs"].([]interface{})
 	h.db.ReserveSequences(uint64(len(docs)))
 
+	if allOrNothing, _ := body["all_or_nothing"].(bool); allOrNothing {
+		return h.bulkDocsAllOrNothing(docs, newEdits)
+	}
+
 	result := make([]db.Body, 0, len(docs))
 	for _, item := range docs {
 		doc := item.(map[string]interface{})
@@ -332,7 +462,7 @@ func (h *handler) handleBulkDocs() error {
 		if err != nil {
 			_, msg := base.ErrorAsHTTPStatus(err)
 			status["error"] = msg
-			base.Log("\tBulkDocs: Doc %q --> %v", docid, err)
+			h.logCtx.Log("\tBulkDocs: Doc %q --> %v", docid, err)
 			err = nil // wrote it to output already; not going to return it
 		} else {
 			status["rev"] = revid
@@ -344,49 +474,148 @@ func (h *handler) handleBulkDocs() error {
 	return nil
 }
 
-func (h *handler) handleChanges() error {
-	// http://wiki.apache.org/couchdb/HTTP_database_API#Changes
-	var options db.ChangesOptions
-	options.Since = h.getIntQuery("since", 0)
-	options.Limit = int(h.getIntQuery("limit", 0))
-	options.Conflicts = (h.getQuery("style") == "all_docs")
-	options.IncludeDocs = (h.getBoolQuery("include_docs"))
-
-	// Get the channels as parameters to an imaginary "bychannel" filter.
-	// The default is all channels the user can access.
-	userChannels := h.user.Channels()
-	filter := h.getQuery("filter")
-	if filter != "" {
-		if filter != "sync_gateway/bychannel" {
-			return &base.HTTPError{http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel"}
+// Implementation of _bulk_docs with "all_or_nothing":true. If any doc fails, none are saved and
+// the response is the error.
+func (h *handler) bulkDocsAllOrNothing(docs []interface{}, newEdits bool) error {
+	updates := make([]db.DocUpdate, len(docs))
+	for i, item := range docs {
+		doc := item.(map[string]interface{})
+		updates[i].DocID, _ = doc["_id"].(string)
+		updates[i].Body = doc
+		if !newEdits {
+			if updates[i].History = db.ParseRevisions(doc); updates[i].History == nil {
+				return &base.HTTPError{http.StatusBadRequest, "Bad _revisions"}
+			}
 		}
-		channelsParam := h.getQuery("channels")
-		if channelsParam == "" {
-			return &base.HTTPError{http.StatusBadRequest, "Missing 'channels' filter parameter"}
+	}
+
+	revids, err := h.db.UpdateAllOrNothing(updates)
+	if err != nil {
+		return err
+	}
+	result := make([]db.Body, len(updates))
+	for i, update := range updates {
+		result[i] = db.Body{"id": update.DocID, "rev": revids[i]}
+		if !newEdits {
+			result[i]["rev"] = update.History[0]
 		}
-		userChannels, err := channels.SetFromArray(strings.Split(channelsParam, ","),
-			channels.ExpandStar)
-		if err != nil {
-			return err
+	}
+	h.writeJSONStatus(http.StatusCreated, result)
+	return nil
+}
+
+// Parameters of a _changes request. These can come from the URL query, from the JSON body
+// of a POST, or from the first message sent over a WebSocket.
+type changesParams struct {
+	Feed        string   `json:"feed"`
+	Since       uint64   `json:"since"`
+	Limit       int      `json:"limit"`
+	Style       string   `json:"style"`
+	IncludeDocs bool     `json:"include_docs"`
+	Filter      string   `json:"filter"`
+	Channels    string   `json:"channels"`
+	DocIDs      []string `json:"doc_ids"`
+	Heartbeat   uint64   `json:"heartbeat"`
+	Timeout     uint64   `json:"timeout"`
+}
+
+func (h *handler) handleChanges() error {
+	// http://wiki.apache.org/couchdb/HTTP_database_API#Changes
+	h.context.stats.changesFeeds.Add(1)
+	defer h.context.stats.changesFeeds.Add(-1)
+
+	params := changesParams{
+		Feed:        h.getQuery("feed"),
+		Since:       h.getIntQuery("since", 0),
+		Limit:       int(h.getIntQuery("limit", 0)),
+		Style:       h.getQuery("style"),
+		IncludeDocs: h.getBoolQuery("include_docs"),
+		Filter:      h.getQuery("filter"),
+		Channels:    h.getQuery("channels"),
+		Heartbeat:   h.getIntQuery("heartbeat", 0),
+		Timeout:     h.getIntQuery("timeout", 60),
+	}
+	if docIDs := h.getQuery("doc_ids"); docIDs != "" {
+		if err := json.Unmarshal([]byte(docIDs), &params.DocIDs); err != nil {
+			return &base.HTTPError{http.StatusBadRequest, "Invalid doc_ids"}
 		}
-		if err := h.user.AuthorizeAllChannels(userChannels); err != nil {
+	}
+	if h.rq.Method == "POST" {
+		// Properties of the JSON body override the URL query:
+		if err := h.readJSONInto(&params); err != nil {
 			return err
 		}
 	}
 
-	if len(userChannels) == 0 {
-		return &base.HTTPError{http.StatusForbidden, "You don't have access to these channels"}
+	if params.Feed == "websocket" {
+		return h.handleWebSocketChanges() // options are sent over the socket, not in the URL
 	}
 
-	switch h.getQuery("feed") {
+	options, userChannels, err := h.getChangesOptions(params)
+	if err != nil {
+		return err
+	}
+
+	switch params.Feed {
 	case "continuous":
-		return h.handleContinuousChanges(userChannels, options)
+		return h.handleContinuousChanges(userChannels, options, params)
+	case "eventsource":
+		return h.handleEventSourceChanges(userChannels, options, params)
 	case "longpoll":
 		options.Wait = true
 	}
 	return h.handleSimpleChanges(userChannels, options)
 }
 
+// Converts changesParams into ChangesOptions, and the set of channels to get changes from.
+func (h *handler) getChangesOptions(params changesParams) (options db.ChangesOptions, userChannels channels.Set, err error) {
+	options.Since = params.Since
+	options.Limit = params.Limit
+	options.Conflicts = (params.Style == "all_docs")
+	options.IncludeDocs = params.IncludeDocs
+
+	// Get the channels as parameters to an imaginary "bychannel" filter.
+	// The default is all channels the user can access.
+	if h.user != nil {
+		userChannels = h.user.Channels()
+	} else {
+		userChannels = channels.SetOf("*")
+	}
+	switch params.Filter {
+	case "":
+	case "sync_gateway/bychannel":
+		if params.Channels == "" {
+			err = &base.HTTPError{http.StatusBadRequest, "Missing 'channels' filter parameter"}
+			return
+		}
+		userChannels, err = channels.SetFromArray(strings.Split(params.Channels, ","),
+			channels.ExpandStar)
+		if err != nil {
+			return
+		}
+		if h.user != nil {
+			if err = h.user.AuthorizeAllChannels(userChannels); err != nil {
+				return
+			}
+		}
+	case "_doc_ids":
+		// The docs are still restricted to the channels the user can access.
+		if params.DocIDs == nil {
+			err = &base.HTTPError{http.StatusBadRequest, "Missing 'doc_ids' filter parameter"}
+			return
+		}
+		options.DocIDs = params.DocIDs
+	default:
+		err = &base.HTTPError{http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel or _doc_ids"}
+		return
+	}
+
+	if len(userChannels) == 0 {
+		err = &base.HTTPError{http.StatusForbidden, "You don't have access to these channels"}
+	}
+	return
+}
+
 func (h *handler) handleSimpleChanges(channels channels.Set, options db.ChangesOptions) error {
 	var lastSeq uint64 = 0
 	var first bool = true
@@ -420,15 +649,57 @@ func (h *handler) handleSimpleChanges(channels channels.Set, options db.ChangesO
 	return err
 }
 
-func (h *handler) handleContinuousChanges(channels channels.Set, options db.ChangesOptions) error {
+func (h *handler) handleContinuousChanges(channels channels.Set, options db.ChangesOptions, params changesParams) error {
+	h.setHeader("Content-Type", "text/plain; charset=utf-8")
+	return h.generateContinuousChanges(channels, options, params.Heartbeat, params.Timeout, nil,
+		func(entry *db.ChangeEntry) error {
+			if entry == nil {
+				return h.writeln([]byte{}) // heartbeat
+			}
+			str, _ := json.Marshal(entry)
+			h.logCtx.LogTo("Changes", "send change: %s", str)
+			return h.writeln(str)
+		})
+}
+
+// Sends changes as Server-Sent Events, for the HTML5 EventSource API:
+// http://www.w3.org/TR/eventsource/
+func (h *handler) handleEventSourceChanges(channels channels.Set, options db.ChangesOptions, params changesParams) error {
+	// A reconnecting EventSource sends the ID of the last event it got, i.e. a sequence number:
+	if lastEventID := h.rq.Header.Get("Last-Event-ID"); lastEventID != "" {
+		since, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return &base.HTTPError{http.StatusBadRequest, "Invalid Last-Event-ID"}
+		}
+		options.Since = since
+	}
+
+	h.setHeader("Content-Type", "text/event-stream; charset=utf-8")
+	h.setHeader("Cache-Control", "no-cache")
+	return h.generateContinuousChanges(channels, options, params.Heartbeat, params.Timeout, nil,
+		func(entry *db.ChangeEntry) error {
+			if entry == nil {
+				return h.writeln([]byte(":")) // heartbeat is a comment line
+			}
+			str, _ := json.Marshal(entry)
+			h.logCtx.LogTo("Changes", "send change: %s", str)
+			return h.writeln([]byte(fmt.Sprintf("id: %d\r\ndata: %s\r\n", entry.Seq, str)))
+		})
+}
+
+// Sends changes to the 'send' function, which is called with a nil entry to send a heartbeat.
+// If there's no heartbeat, stops after the timeout. Also stops when the limit is reached,
+// 'done' is closed or 'send' fails.
+func (h *handler) generateContinuousChanges(channels channels.Set, options db.ChangesOptions,
+	heartbeatMs, timeoutMs uint64, done <-chan bool, send func(*db.ChangeEntry) error) error {
 	var timeout <-chan time.Time
 	var heartbeat <-chan time.Time
-	if ms := h.getIntQuery("heartbeat", 0); ms > 0 {
-		ticker := time.NewTicker(time.Duration(ms) * time.Millisecond)
+	if heartbeatMs > 0 {
+		ticker := time.NewTicker(time.Duration(heartbeatMs) * time.Millisecond)
 		defer ticker.Stop()
 		heartbeat = ticker.C
-	} else if ms := h.getIntQuery("timeout", 60); ms > 0 {
-		timer := time.NewTimer(time.Duration(ms) * time.Millisecond)
+	} else if timeoutMs > 0 {
+		timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
 		defer timer.Stop()
 		timeout = timer.C
 	}
@@ -452,9 +723,7 @@ loop:
 			if entry == nil {
 				feed = nil
 			} else {
-				str, _ := json.Marshal(entry)
-				base.LogTo("Changes", "send change: %s", str)
-				err = h.writeln(str)
+				err = send(entry)
 
 				options.Since = entry.Seq // so next call to ChangesFeed will start from end
 				if options.Limit > 0 {
@@ -465,9 +734,11 @@ loop:
 				}
 			}
 		case <-heartbeat:
-			err = h.writeln([]byte{})
+			err = send(nil)
 		case <-timeout:
 			break loop
+		case <-done:
+			break loop
 		}
 		if err != nil {
 			return nil // error is probably because the client closed the connection
@@ -497,14 +768,91 @@ func (h *handler) handleGetAttachment() error {
 		return err
 	}
 
-	h.setHeader("Etag", digest)
+	h.setEtag(digest)
 	if contentType, ok := meta["content_type"].(string); ok {
 		h.setHeader("Content-Type", contentType)
 	}
 	if encoding, ok := meta["encoding"].(string); ok {
 		h.setHeader("Content-Encoding", encoding)
 	}
-	h.response.Write(data)
+	// ServeContent handles Range, If-Range and If-None-Match, and sets Content-Length:
+	h.disableCompression()
+	http.ServeContent(h.response, h.rq, "", time.Time{}, bytes.NewReader(data))
+	return nil
+}
+
+// HTTP handler for a PUT of an attachment, which creates a new revision of its document
+func (h *handler) handlePutAttachment() error {
+	docid := h.PathVars()["docid"]
+	attachmentName := h.PathVars()["attach"]
+	revid, err := h.getRevID()
+	if err != nil {
+		return err
+	}
+	attachmentContentType := h.rq.Header.Get("Content-Type")
+	if attachmentContentType == "" {
+		attachmentContentType = "application/octet-stream"
+	}
+	attachmentData, err := ioutil.ReadAll(h.rq.Body)
+	if err != nil {
+		return err
+	}
+
+	body, err := h.db.GetRev(docid, revid, false, nil)
+	if err != nil {
+		if status, _ := base.ErrorAsHTTPStatus(err); status != http.StatusNotFound || revid != "" {
+			return err
+		}
+		body = db.Body{} // PUTting an attachment to a nonexistent doc creates the doc
+	}
+	body["_rev"] = revid
+
+	attachments := db.BodyAttachments(body)
+	if attachments == nil {
+		attachments = map[string]interface{}{}
+		body["_attachments"] = attachments
+	}
+	attachments[attachmentName] = map[string]interface{}{
+		"content_type": attachmentContentType,
+		"data":         attachmentData,
+	}
+
+	newRev, err := h.db.Put(docid, body)
+	if err != nil {
+		return err
+	}
+	h.setEtag(newRev)
+	h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true, "id": docid, "rev": newRev})
+	return nil
+}
+
+// HTTP handler for a DELETE of an attachment, which creates a new revision of its document
+func (h *handler) handleDeleteAttachment() error {
+	docid := h.PathVars()["docid"]
+	attachmentName := h.PathVars()["attach"]
+	revid, err := h.getRevID()
+	if err != nil {
+		return err
+	}
+	if revid == "" {
+		return &base.HTTPError{http.StatusConflict, "Missing rev"}
+	}
+	body, err := h.db.GetRev(docid, revid, false, nil)
+	if err != nil {
+		return err
+	}
+	attachments := db.BodyAttachments(body)
+	if _, exists := attachments[attachmentName]; !exists {
+		return &base.HTTPError{http.StatusNotFound, "missing " + attachmentName}
+	}
+	delete(attachments, attachmentName)
+
+	newRev, err := h.db.Put(docid, body)
+	if err != nil {
+		return err
+	}
+	h.setEtag(newRev)
+	h.writeJSON(db.Body{"ok": true, "id": docid, "rev": newRev})
 	return nil
 }
 
@@ -568,10 +916,43 @@ func (h *handler) handleRoot() error {
 	return nil
 }
 
-func (h *handler) handleOptions() error {
-	//FIX: This is inaccurate; should figure out what methods the requested URL handles.
-	h.setHeader("Accept", "GET, HEAD, PUT, DELETE, POST")
-	return nil
+// Name of the catch-all route that handles unknown URLs.
+const kBadRouteName = "badRoute"
+
+// Returns a handler for OPTIONS requests, which finds the methods that the router handles for
+// the requested URL. If it's a CORS preflight request from an allowed origin, it's approved.
+func optionsHandler(router *mux.Router) handlerMethod {
+	return func(h *handler) error {
+		methods := []string{}
+		dbName := ""
+		for _, method := range []string{"GET", "HEAD", "PUT", "POST", "DELETE", "COPY"} {
+			probe, _ := http.NewRequest(method, h.rq.URL.String(), nil)
+			var match mux.RouteMatch
+			if router.Match(probe, &match) && match.Route.GetName() != kBadRouteName {
+				methods = append(methods, method)
+				if match.Vars["db"] != "" {
+					dbName = match.Vars["db"]
+				}
+			}
+		}
+		if len(methods) == 0 {
+			return h.handleBadRoute()
+		}
+		methods = append(methods, "OPTIONS")
+		h.setHeader("Allow", strings.Join(methods, ", "))
+
+		cors := h.addCORSHeaders(dbName)
+		if cors != nil && h.rq.Header.Get("Access-Control-Request-Method") != "" {
+			h.setHeader("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			if len(cors.Headers) > 0 {
+				h.setHeader("Access-Control-Allow-Headers", strings.Join(cors.Headers, ", "))
+			}
+			if cors.MaxAge > 0 {
+				h.setHeader("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+			}
+		}
+		return nil
+	}
 }
 
 func (h *handler) handleBadRoute() error {
@@ -580,14 +961,21 @@ func (h *handler) handleBadRoute() error {
 
 func (h *handler) handleAllDbs() error {
 	if h.rq.Method == "GET" || h.rq.Method == "HEAD" {
-		h.writeJSON([]string{h.context.dbcontext.Name})
+		h.writeJSON(h.server.allDatabaseNames())
 		return nil
 	}
 	return kBadMethodError
 }
 
 func (h *handler) handleVacuum() error {
-	attsDeleted, err := db.VacuumAttachments(h.context.dbcontext.Bucket)
+	var attsDeleted int
+	task, err := h.db.StartTask("vacuum", h.db.Name, func(task *db.Task) (err error) {
+		attsDeleted, err = db.VacuumAttachments(h.db.Bucket)
+		return
+	})
+	if err == nil {
+		err = task.Wait()
+	}
 	if err != nil {
 		return err
 	}
@@ -595,13 +983,183 @@ func (h *handler) handleVacuum() error {
 	return nil
 }
 
+// Starts compacting the database in the background (admin only.)
+func (h *handler) handleCompact() error {
+	task, err := h.db.StartCompaction()
+	if err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, db.Body{"ok": true, "task_id": task.ID()})
+	return nil
+}
+
+// Reports the progress of the database's current or most recent compaction (admin only.)
+func (h *handler) handleGetCompactStatus() error {
+	h.writeJSON(h.db.CompactionStatus())
+	return nil
+}
+
+// Permanently removes document revisions (admin only.) The body maps doc IDs to arrays of
+// leaf revision IDs; "*" purges every revision of a document.
+func (h *handler) handlePurge() error {
+	var input map[string][]string
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	}
+	purged := map[string][]string{}
+	for docid, revids := range input {
+		revs, err := h.db.Purge(docid, revids)
+		if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(revs) > 0 {
+			purged[docid] = revs
+		}
+	}
+	h.writeJSON(db.Body{"purged": purged})
+	return nil
+}
+
+// Lists the revisions purged since a sequence, so clients can drop their local copies.
+func (h *handler) handleGetPurgedInfos() error {
+	infos, err := h.db.GetPurgedInfos(h.getIntQuery("since", 0))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"purged_infos": infos})
+	return nil
+}
+
+// The JSON body of a POST to /_replicate.
+type replicateParams struct {
+	Source     string   `json:"source"`
+	Target     string   `json:"target"`
+	Channels   []string `json:"channels,omitempty"`
+	DocIDs     []string `json:"doc_ids,omitempty"`
+	Continuous bool     `json:"continuous,omitempty"`
+	Cancel     bool     `json:"cancel,omitempty"`
+}
+
+// Replicates between a local database and a remote one, in whichever direction the "source"
+// and "target" URLs specify (admin only.) A one-shot replication responds when it's done; a
+// continuous one is started in the background, or stopped if "cancel" is set.
+func (h *handler) handleReplicate() error {
+	var params replicateParams
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	push := isRemoteURL(params.Target)
+	localName, remote := params.Target, params.Source
+	if push {
+		localName, remote = params.Source, params.Target
+	}
+	context := h.server.getDatabase(localName)
+	if context == nil {
+		return &base.HTTPError{http.StatusNotFound, "no such local database " + localName}
+	}
+	local, err := db.GetDatabase(context.dbcontext, nil)
+	if err != nil {
+		return err
+	}
+	replParams := db.ReplicationParams{
+		Remote:     remote,
+		Channels:   params.Channels,
+		DocIDs:     params.DocIDs,
+		Continuous: params.Continuous,
+	}
+	var replicator *db.Replicator
+	if push {
+		replicator, err = db.NewPushReplicator(local, replParams)
+	} else {
+		replicator, err = db.NewPullReplicator(local, replParams)
+	}
+	if err != nil {
+		return err
+	}
+
+	if params.Cancel {
+		if err := context.dbcontext.StopReplication(replicator.ID()); err != nil {
+			return err
+		}
+		h.writeJSONStatus(http.StatusAccepted, db.Body{"ok": true, "_local_id": replicator.ID()})
+		return nil
+	}
+	task, err := context.dbcontext.StartReplication(replicator)
+	if err != nil {
+		return err
+	}
+	if params.Continuous {
+		h.writeJSONStatus(http.StatusAccepted,
+			db.Body{"ok": true, "_local_id": replicator.ID(), "task_id": task.ID()})
+		return nil
+	}
+	if err := task.Wait(); err != nil {
+		return err
+	}
+	h.writeJSON(struct {
+		OK bool `json:"ok"`
+		db.ReplicationStats
+	}{true, replicator.Stats()})
+	return nil
+}
+
+// Lists the background tasks running on all databases (admin only.)
+func (h *handler) handleActiveTasks() error {
+	tasks := []db.Body{}
+	for _, name := range h.server.allDatabaseNames() {
+		if context := h.server.getDatabase(name); context != nil {
+			for _, task := range context.dbcontext.ActiveTasks() {
+				tasks = append(tasks, task.Info())
+			}
+		}
+	}
+	h.writeJSON(tasks)
+	return nil
+}
+
+// Cancels a background task (admin only.)
+func (h *handler) handleCancelTask() error {
+	taskID := h.PathVars()["taskid"]
+	for _, name := range h.server.allDatabaseNames() {
+		if context := h.server.getDatabase(name); context != nil {
+			if err := context.dbcontext.CancelTask(taskID); err == nil {
+				h.writeJSON(db.Body{"ok": true})
+				return nil
+			}
+		}
+	}
+	return &base.HTTPError{http.StatusNotFound, "No such task"}
+}
+
+func isRemoteURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// Creates a database, configured by an optional DbConfig in the request body (admin only.)
 func (h *handler) handleCreateDB() error {
-	if h.server.databases[h.PathVars()["newdb"]] != nil {
+	dbName := h.PathVars()["newdb"]
+	if h.server.getDatabase(dbName) != nil {
 		return &base.HTTPError{http.StatusConflict, "already exists"}
-	} else {
+	} else if !h.admin {
 		return &base.HTTPError{http.StatusForbidden, "can't create any databases"}
 	}
-	return nil // unreachable
+	var config DbConfig
+	if h.rq.ContentLength != 0 {
+		if err := h.readJSONInto(&config); err != nil {
+			return err
+		}
+	}
+	if config.Name != "" && config.Name != dbName {
+		return &base.HTTPError{http.StatusBadRequest, "Database name doesn't match URL"}
+	}
+	config.Name = dbName
+	if err := h.server.createDatabase(config); err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true})
+	return nil
 }
 
 func (h *handler) handleGetDB() error {
@@ -620,7 +1178,44 @@ func (h *handler) handleDeleteDB() error {
 	if !h.admin {
 		return &base.HTTPError{http.StatusForbidden, "forbidden (admins only)"}
 	}
-	return h.db.Delete()
+	// Unregister the database first, so new requests to it fail while its docs are deleted:
+	context, err := h.server.removeDatabase(h.db.Name)
+	if context == nil {
+		return err
+	}
+	defer context.dbcontext.Close()
+	if err != nil {
+		return err
+	}
+	if h.getBoolQuery("delete_docs") {
+		if err := h.db.Delete(); err != nil {
+			return err
+		}
+	}
+	h.writeJSON(db.Body{"ok": true})
+	return nil
+}
+
+func (h *handler) handleGetRevsLimit() error {
+	h.writeJSON(h.db.RevsLimit())
+	return nil
+}
+
+func (h *handler) handlePutRevsLimit() error {
+	if !h.admin {
+		return &base.HTTPError{http.StatusForbidden, "forbidden (admins only)"}
+	}
+	var limit uint32
+	if err := h.readJSONInto(&limit); err != nil {
+		return err
+	} else if limit == 0 {
+		return &base.HTTPError{http.StatusBadRequest, "revs_limit must be positive"}
+	}
+	if err := h.server.setRevsLimit(h.db.DatabaseContext, limit); err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"ok": true})
+	return nil
 }
 
 func (h *handler) handleEFC() error { // Handles _ensure_full_commit.
@@ -657,11 +1252,14 @@ func createHandler(sc *serverContext) http.Handler {
 	dbr := r.PathPrefix("/{db}/").Subrouter()
 	dbr.Handle("/_all_docs", makeHandler(sc, (*handler).handleAllDocs)).Methods("GET", "HEAD", "POST")
 	dbr.Handle("/_bulk_docs", makeHandler(sc, (*handler).handleBulkDocs)).Methods("POST")
-	dbr.Handle("/_bulk_get", makeHandler(sc, (*handler).handleBulkGet)).Methods("GET", "HEAD")
-	dbr.Handle("/_changes", makeHandler(sc, (*handler).handleChanges)).Methods("GET", "HEAD")
+	dbr.Handle("/_bulk_get", makeHandler(sc, (*handler).handleBulkGet)).Methods("POST")
+	dbr.Handle("/_changes", makeHandler(sc, (*handler).handleChanges)).Methods("GET", "HEAD", "POST")
 	dbr.Handle("/_design/sync_gateway", makeHandler(sc, (*handler).handleDesign)).Methods("GET", "HEAD")
 	dbr.Handle("/_ensure_full_commit", makeHandler(sc, (*handler).handleEFC)).Methods("POST")
 	dbr.Handle("/_revs_diff", makeHandler(sc, (*handler).handleRevsDiff)).Methods("POST")
+	dbr.Handle("/_purged_infos", makeHandler(sc, (*handler).handleGetPurgedInfos)).Methods("GET", "HEAD")
+	dbr.Handle("/_revs_limit", makeHandler(sc, (*handler).handleGetRevsLimit)).Methods("GET", "HEAD")
+	dbr.Handle("/_revs_limit", makeHandler(sc, (*handler).handlePutRevsLimit)).Methods("PUT")
 
 	// Document URLs:
 	dbr.Handle("/_local/{docid}", makeHandler(sc, (*handler).handleGetLocalDoc)).Methods("GET", "HEAD")
@@ -671,12 +1269,15 @@ func createHandler(sc *serverContext) http.Handler {
 	dbr.Handle("/{docid}", makeHandler(sc, (*handler).handleGetDoc)).Methods("GET", "HEAD")
 	dbr.Handle("/{docid}", makeHandler(sc, (*handler).handlePutDoc)).Methods("PUT")
 	dbr.Handle("/{docid}", makeHandler(sc, (*handler).handleDeleteDoc)).Methods("DELETE")
+	dbr.Handle("/{docid}", makeHandler(sc, (*handler).handleCopyDoc)).Methods("COPY")
 
 	dbr.Handle("/{docid}/{attach}", makeHandler(sc, (*handler).handleGetAttachment)).Methods("GET", "HEAD")
+	dbr.Handle("/{docid}/{attach}", makeHandler(sc, (*handler).handlePutAttachment)).Methods("PUT")
+	dbr.Handle("/{docid}/{attach}", makeHandler(sc, (*handler).handleDeleteAttachment)).Methods("DELETE")
 
 	// Fallbacks that have to be added last:
-	r.PathPrefix("/").Methods("OPTIONS").Handler(makeHandler(sc, (*handler).handleOptions))
-	r.PathPrefix("/").Handler(makeHandler(sc, (*handler).handleBadRoute))
+	r.PathPrefix("/").Methods("OPTIONS").Handler(makeHandler(sc, optionsHandler(r)))
+	r.PathPrefix("/").Handler(makeHandler(sc, (*handler).handleBadRoute)).Name(kBadRouteName)
 
 	return r
 }
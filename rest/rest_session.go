@@ -60,7 +60,7 @@ func (h *handler) handleSessionPOST() error {
 		return err
 	}
 	var user auth.User
-	user, err = h.context.auth.GetUser(params.Name)
+	user, err = h.authenticator().GetUser(params.Name)
 	if err != nil {
 		return err
 	}
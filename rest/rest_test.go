@@ -11,14 +11,24 @@ package rest
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"sort"
+	"strings"
 	"testing"
 
+	"github.com/gorilla/websocket"
 	"github.com/sdegutis/go.assert"
 
 	"github.com/couchbaselabs/sync_gateway/base"
@@ -39,6 +49,10 @@ func init() {
 }
 
 func callREST(method, resource string, body string) *httptest.ResponseRecorder {
+	return callRESTWithHeaders(method, resource, body, nil)
+}
+
+func callRESTWithHeaders(method, resource string, body string, headers map[string]string) *httptest.ResponseRecorder {
 	sc := newServerContext(&ServerConfig{})
 	if err := sc.addDatabase(gTestBucket, "db", false); err != nil {
 		panic(fmt.Sprintf("Error from addDatabase: %v", err))
@@ -47,6 +61,9 @@ func callREST(method, resource string, body string) *httptest.ResponseRecorder {
 
 	input := bytes.NewBufferString(body)
 	request, _ := http.NewRequest(method, "http://localhost"+resource, input)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
 	response := httptest.NewRecorder()
 	response.Code = 200 // doesn't seem to be initialized by default; filed Go bug #4188
 
@@ -75,6 +92,19 @@ func TestRoot(t *testing.T) {
 	assertStatus(t, response, 405)
 }
 
+func TestRequestID(t *testing.T) {
+	response := callREST("GET", "/db/", "")
+	assertStatus(t, response, 200)
+	requestID := response.Header().Get("X-Request-ID")
+	assert.Equals(t, len(requestID), 16)
+	response = callREST("GET", "/db/", "")
+	assert.False(t, response.Header().Get("X-Request-ID") == requestID)
+
+	response = callRESTWithHeaders("GET", "/db/", "", map[string]string{"X-Request-ID": "client-id-1"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("X-Request-ID"), "client-id-1")
+}
+
 func createDoc(t *testing.T, docid string) string {
 	response := callREST("PUT", "/db/"+docid, `{"prop":true}`)
 	assertStatus(t, response, 201)
@@ -203,3 +233,620 @@ func TestLocalDocs(t *testing.T) {
 	response = callREST("DELETE", "/db/_local/loc1", "")
 	assertStatus(t, response, 404)
 }
+
+func TestOpenRevs(t *testing.T) {
+	// Create a document with two conflicting branches:
+	input := `{"new_edits":false, "docs": [
+                    {"_id": "or1", "_rev": "2-abc", "n": 1,
+                     "_revisions": {"start": 2, "ids": ["abc", "one"]}},
+                    {"_id": "or1", "_rev": "2-def", "n": 2,
+                     "_revisions": {"start": 2, "ids": ["def", "one"]}}
+              ]}`
+	response := callREST("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+
+	readParts := func(response *httptest.ResponseRecorder) []db.Body {
+		contentType, attrs, _ := mime.ParseMediaType(response.Header().Get("Content-Type"))
+		assert.Equals(t, contentType, "multipart/mixed")
+		reader := multipart.NewReader(response.Body, attrs["boundary"])
+		bodies := []db.Body{}
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			var body db.Body
+			assert.Equals(t, json.NewDecoder(part).Decode(&body), nil)
+			bodies = append(bodies, body)
+		}
+		return bodies
+	}
+
+	response = callREST("GET", "/db/or1?open_revs=all", "")
+	assertStatus(t, response, 200)
+	bodies := readParts(response)
+	assert.Equals(t, len(bodies), 2)
+	revs := []string{bodies[0]["_rev"].(string), bodies[1]["_rev"].(string)}
+	sort.Strings(revs)
+	assert.DeepEquals(t, revs, []string{"2-abc", "2-def"})
+
+	response = callREST("GET", `/db/or1?open_revs=["2-abc","3-nope"]`, "")
+	assertStatus(t, response, 200)
+	bodies = readParts(response)
+	assert.Equals(t, len(bodies), 2)
+	assert.Equals(t, bodies[0]["_rev"], "2-abc")
+	assert.DeepEquals(t, bodies[1], db.Body{"missing": "3-nope"})
+
+	response = callREST("GET", "/db/or_nosuchdoc?open_revs=all", "")
+	assertStatus(t, response, 404)
+}
+
+func TestAllDocsPaging(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		createDoc(t, fmt.Sprintf("page%d", i))
+	}
+
+	type allDocsResponse struct {
+		TotalRows int `json:"total_rows"`
+		Offset    int `json:"offset"`
+		UpdateSeq int `json:"update_seq"`
+		Rows      []struct {
+			ID string `json:"id"`
+		} `json:"rows"`
+	}
+	query := func(params string) (result allDocsResponse) {
+		response := callREST("GET", "/db/_all_docs?"+params, "")
+		assertStatus(t, response, 200)
+		json.Unmarshal(response.Body.Bytes(), &result)
+		return
+	}
+
+	result := query(`startkey="page2"&endkey="page8"&limit=3&skip=1&update_seq=true`)
+	assert.Equals(t, len(result.Rows), 3)
+	assert.Equals(t, result.Rows[0].ID, "page3")
+	assert.Equals(t, result.Rows[2].ID, "page5")
+	assert.True(t, result.UpdateSeq > 0)
+	before := result.Offset - 1 // number of docs that sort before "page2"
+
+	result = query(`startkey="page5"&endkey="page3"&descending=true&inclusive_end=false`)
+	assert.Equals(t, len(result.Rows), 2)
+	assert.Equals(t, result.Rows[0].ID, "page5")
+	assert.Equals(t, result.Rows[1].ID, "page4")
+	assert.Equals(t, result.Offset, result.TotalRows-before-4) // docs after "page5"
+
+	response := callREST("GET", "/db/_all_docs?startkey=page2", "")
+	assertStatus(t, response, 400)
+}
+
+func TestChangesWebSocket(t *testing.T) {
+	createDoc(t, "wsdoc")
+	response := callREST("GET", "/db/_changes", "")
+	assertStatus(t, response, 200)
+	var changes struct {
+		LastSeq uint64 `json:"last_seq"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.True(t, changes.LastSeq > 0)
+
+	sc := newServerContext(&ServerConfig{})
+	if err := sc.addDatabase(gTestBucket, "db", false); err != nil {
+		t.Fatalf("Error from addDatabase: %v", err)
+	}
+	server := httptest.NewServer(createHandler(sc))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/db/_changes?feed=websocket"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Couldn't open WebSocket: %v", err)
+	}
+	defer conn.Close()
+	options := fmt.Sprintf(`{"since":%d, "limit":1}`, changes.LastSeq-1)
+	assert.Equals(t, conn.WriteMessage(websocket.TextMessage, []byte(options)), nil)
+
+	var entry db.ChangeEntry
+	assert.Equals(t, conn.ReadJSON(&entry), nil)
+	assert.Equals(t, entry.Seq, changes.LastSeq)
+	assert.Equals(t, entry.ID, "wsdoc")
+
+	// After reaching the limit the server should close the socket:
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+}
+
+func TestChangesWebSocketOrigin(t *testing.T) {
+	sc := newServerContext(&ServerConfig{CORS: &CORSConfig{Origin: []string{"http://example.com"}}})
+	if err := sc.addDatabase(gTestBucket, "db", false); err != nil {
+		t.Fatalf("Error from addDatabase: %v", err)
+	}
+	server := httptest.NewServer(createHandler(sc))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/db/_changes?feed=websocket"
+
+	// A page from a foreign origin is refused:
+	_, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://evil.com"}})
+	assert.True(t, err != nil)
+	assert.Equals(t, response.StatusCode, 403)
+
+	// Pages from the server's own host, or from an allowed CORS origin, are accepted:
+	for _, origin := range []string{server.URL, "http://example.com"} {
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		assert.Equals(t, err, nil)
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestChangesEventSource(t *testing.T) {
+	createDoc(t, "esdoc1")
+	createDoc(t, "esdoc2")
+	response := callREST("GET", "/db/_changes", "")
+	var changes struct {
+		LastSeq uint64 `json:"last_seq"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &changes)
+
+	response = callREST("GET", fmt.Sprintf("/db/_changes?feed=eventsource&since=%d&limit=1",
+		changes.LastSeq-1), "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Type"), "text/event-stream; charset=utf-8")
+	assert.True(t, strings.HasPrefix(response.Body.String(),
+		fmt.Sprintf("id: %d\r\ndata: {\"seq\":%d,\"id\":\"esdoc2\"", changes.LastSeq, changes.LastSeq)))
+
+	// Last-Event-ID overrides the 'since' parameter:
+	response = callRESTWithHeaders("GET", "/db/_changes?feed=eventsource&since=0&limit=1", "",
+		map[string]string{"Last-Event-ID": fmt.Sprintf("%d", changes.LastSeq-2)})
+	assertStatus(t, response, 200)
+	assert.True(t, strings.Contains(response.Body.String(), `"id":"esdoc1"`))
+	assert.True(t, strings.HasSuffix(response.Body.String(), "\r\n\r\n"))
+}
+
+func TestChangesDocIDsFilter(t *testing.T) {
+	createDoc(t, "filterdoc1")
+	createDoc(t, "filterdoc2")
+	createDoc(t, "filterdoc3")
+
+	type changesResponse struct {
+		Results []db.ChangeEntry `json:"results"`
+	}
+	var changes changesResponse
+	response := callREST("GET", `/db/_changes?filter=_doc_ids&doc_ids=["filterdoc3","filterdoc1"]`, "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 2)
+	assert.Equals(t, changes.Results[0].ID, "filterdoc1")
+	assert.Equals(t, changes.Results[1].ID, "filterdoc3")
+
+	response = callREST("POST", "/db/_changes", `{"filter":"_doc_ids", "doc_ids":["filterdoc2"]}`)
+	assertStatus(t, response, 200)
+	changes = changesResponse{}
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].ID, "filterdoc2")
+
+	assertStatus(t, callREST("GET", "/db/_changes?filter=_doc_ids", ""), 400)
+	assertStatus(t, callREST("GET", "/db/_changes?filter=_doc_ids&doc_ids=filterdoc1", ""), 400)
+	assertStatus(t, callREST("GET", "/db/_changes?filter=bogus", ""), 400)
+}
+
+func TestAttachmentPutAndDelete(t *testing.T) {
+	// PUT an attachment to a new doc:
+	response := callRESTWithHeaders("PUT", "/db/attdoc/photo.png", "fake PNG data",
+		map[string]string{"Content-Type": "image/png"})
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["ok"], true)
+	revid := body["rev"].(string)
+
+	response = callREST("GET", "/db/attdoc/photo.png", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "fake PNG data")
+	assert.Equals(t, response.Header().Get("Content-Type"), "image/png")
+
+	// Can't add another attachment without the current rev:
+	assertStatus(t, callREST("PUT", "/db/attdoc/notes.txt", "hi"), 409)
+
+	response = callREST("PUT", "/db/attdoc/notes.txt?rev="+revid, "hi")
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	revid = body["rev"].(string)
+	assert.True(t, strings.HasPrefix(revid, "2-"))
+	response = callREST("GET", "/db/attdoc/notes.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Type"), "application/octet-stream")
+
+	// Now delete the first attachment:
+	assertStatus(t, callREST("DELETE", "/db/attdoc/photo.png", ""), 409)
+	assertStatus(t, callREST("DELETE", "/db/attdoc/nosuch.png?rev="+revid, ""), 404)
+	response = callREST("DELETE", "/db/attdoc/photo.png?rev="+revid, "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.True(t, strings.HasPrefix(body["rev"].(string), "3-"))
+	assertStatus(t, callREST("GET", "/db/attdoc/photo.png", ""), 404)
+	response = callREST("GET", "/db/attdoc/notes.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "hi")
+}
+
+func TestCopyDoc(t *testing.T) {
+	response := callRESTWithHeaders("PUT", "/db/copysrc/photo.png", "fake PNG data",
+		map[string]string{"Content-Type": "image/png"})
+	assertStatus(t, response, 201)
+
+	assertStatus(t, callREST("COPY", "/db/copysrc", ""), 400)
+	assertStatus(t, callRESTWithHeaders("COPY", "/db/nosuchdoc", "",
+		map[string]string{"Destination": "copydst"}), 404)
+
+	response = callRESTWithHeaders("COPY", "/db/copysrc", "",
+		map[string]string{"Destination": "copydst"})
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["id"], "copydst")
+	revid := body["rev"].(string)
+	assert.True(t, strings.HasPrefix(revid, "1-"))
+	assert.Equals(t, response.Header().Get("Etag"), `"`+revid+`"`)
+
+	response = callREST("GET", "/db/copydst/photo.png", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "fake PNG data")
+	assert.Equals(t, response.Header().Get("Content-Type"), "image/png")
+
+	// Copying over an existing doc requires its current rev:
+	assertStatus(t, callRESTWithHeaders("COPY", "/db/copysrc", "",
+		map[string]string{"Destination": "copydst"}), 409)
+	response = callRESTWithHeaders("COPY", "/db/copysrc", "",
+		map[string]string{"Destination": "copydst?rev=" + revid})
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.True(t, strings.HasPrefix(body["rev"].(string), "2-"))
+
+	// A destination ID with a colon isn't mistaken for a URL scheme, and can be escaped:
+	response = callRESTWithHeaders("COPY", "/db/copysrc", "",
+		map[string]string{"Destination": "user:1"})
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["id"], "user:1")
+	assertStatus(t, callREST("GET", "/db/user:1", ""), 200)
+	response = callRESTWithHeaders("COPY", "/db/copysrc", "",
+		map[string]string{"Destination": "user%3A2%3F"})
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["id"], "user:2?")
+}
+
+func TestAttachmentRanges(t *testing.T) {
+	response := callREST("PUT", "/db/rangedoc/data.txt", "0123456789")
+	assertStatus(t, response, 201)
+
+	response = callREST("GET", "/db/rangedoc/data.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Accept-Ranges"), "bytes")
+	assert.Equals(t, response.Header().Get("Content-Length"), "10")
+	etag := response.Header().Get("Etag")
+	assert.True(t, strings.HasPrefix(etag, `"sha1-`))
+
+	response = callRESTWithHeaders("GET", "/db/rangedoc/data.txt", "",
+		map[string]string{"If-None-Match": etag})
+	assertStatus(t, response, 304)
+
+	response = callRESTWithHeaders("GET", "/db/rangedoc/data.txt", "",
+		map[string]string{"Range": "bytes=2-4"})
+	assertStatus(t, response, 206)
+	assert.Equals(t, response.Body.String(), "234")
+	assert.Equals(t, response.Header().Get("Content-Range"), "bytes 2-4/10")
+
+	// If-Range with a stale Etag gets the entire attachment:
+	response = callRESTWithHeaders("GET", "/db/rangedoc/data.txt", "",
+		map[string]string{"Range": "bytes=2-4", "If-Range": `"sha1-bogus"`})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "0123456789")
+
+	response = callRESTWithHeaders("GET", "/db/rangedoc/data.txt", "",
+		map[string]string{"Range": "bytes=0-1,8-"})
+	assertStatus(t, response, 206)
+	mediaType, _, _ := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	assert.Equals(t, mediaType, "multipart/byteranges")
+
+	response = callRESTWithHeaders("GET", "/db/rangedoc/data.txt", "",
+		map[string]string{"Range": "bytes=20-30"})
+	assertStatus(t, response, 416)
+}
+
+func TestCORS(t *testing.T) {
+	sc := newServerContext(&ServerConfig{CORS: &CORSConfig{
+		Origin:      []string{"http://example.com"},
+		Headers:     []string{"Content-Type"},
+		MaxAge:      600,
+		Credentials: true,
+	}})
+	if err := sc.addDatabase(gTestBucket, "db", false); err != nil {
+		t.Fatalf("Error from addDatabase: %v", err)
+	}
+	handler := createHandler(sc)
+	call := func(method, resource, origin string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, "http://localhost"+resource, nil)
+		request.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			request.Header.Set("Access-Control-Request-Method", "PUT")
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	// Preflight:
+	response := call("OPTIONS", "/db/corsdoc", "http://example.com")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Allow"), "GET, HEAD, PUT, DELETE, COPY, OPTIONS")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://example.com")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Methods"), "GET, HEAD, PUT, DELETE, COPY, OPTIONS")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Headers"), "Content-Type")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Credentials"), "true")
+	assert.Equals(t, response.Header().Get("Access-Control-Max-Age"), "600")
+	response = call("OPTIONS", "/db/corsdoc/attachment", "http://example.com")
+	assert.Equals(t, response.Header().Get("Allow"), "GET, HEAD, PUT, DELETE, OPTIONS")
+	response = call("OPTIONS", "/db/corsdoc", "http://evil.com")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Methods"), "")
+	assertStatus(t, call("OPTIONS", "/db/corsdoc/att/extra", "http://example.com"), 405)
+
+	// Regular requests, including errors:
+	response = call("GET", "/db/", "http://example.com")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://example.com")
+	response = call("GET", "/db/nosuchcorsdoc", "http://example.com")
+	assertStatus(t, response, 404)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://example.com")
+	response = call("GET", "/db/", "http://evil.com")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "")
+
+	// A database's config overrides the server's:
+	sc.getDatabase("db").cors = &CORSConfig{Origin: []string{"*"}}
+	response = call("GET", "/db/", "http://evil.com")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://evil.com")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Credentials"), "")
+	response = call("OPTIONS", "/db/corsdoc", "http://evil.com")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://evil.com")
+	response = call("GET", "/_session", "http://evil.com")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "")
+}
+
+func TestDocEtags(t *testing.T) {
+	revid := createDoc(t, "etagdoc")
+	response := callREST("GET", "/db/etagdoc", "")
+	assertStatus(t, response, 200)
+	etag := response.Header().Get("Etag")
+	assert.Equals(t, etag, `"`+revid+`"`)
+
+	response = callRESTWithHeaders("GET", "/db/etagdoc", "", map[string]string{"If-None-Match": etag})
+	assertStatus(t, response, 304)
+	assert.Equals(t, response.Body.Len(), 0)
+	assert.Equals(t, response.Header().Get("Etag"), etag)
+	response = callRESTWithHeaders("GET", "/db/etagdoc", "", map[string]string{"If-None-Match": `"1-bogus"`})
+	assertStatus(t, response, 200)
+	response = callRESTWithHeaders("GET", "/db/etagdoc", "", map[string]string{"If-None-Match": `"1-bogus", ` + etag})
+	assertStatus(t, response, 304)
+	response = callRESTWithHeaders("GET", "/db/etagdoc", "", map[string]string{"If-None-Match": `"1-bogus", "2-bogus"`})
+	assertStatus(t, response, 200)
+	response = callRESTWithHeaders("GET", "/db/etagdoc", "", map[string]string{"If-None-Match": "W/" + etag})
+	assertStatus(t, response, 304)
+	response = callRESTWithHeaders("GET", "/db/etagdoc", "", map[string]string{"If-None-Match": "*"})
+	assertStatus(t, response, 304)
+	response = callRESTWithHeaders("GET", "/db/etagdoc", "", map[string]string{"If-None-Match": `"1-bogus`})
+	assertStatus(t, response, 400)
+
+	// Update the doc using If-Match instead of _rev:
+	response = callRESTWithHeaders("PUT", "/db/etagdoc", `{"prop":2}`, map[string]string{"If-Match": etag})
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	revid2 := body["rev"].(string)
+	assert.Equals(t, response.Header().Get("Etag"), `"`+revid2+`"`)
+
+	response = callRESTWithHeaders("PUT", "/db/etagdoc", `{"prop":3}`, map[string]string{"If-Match": etag})
+	assertStatus(t, response, 409)
+	response = callRESTWithHeaders("PUT", "/db/etagdoc", `{"prop":3}`,
+		map[string]string{"If-Match": etag + `, "` + revid2 + `"`})
+	assertStatus(t, response, 400)
+	response = callRESTWithHeaders("PUT", "/db/etagdoc", `{"prop":3}`, map[string]string{"If-Match": "W/" + etag})
+	assertStatus(t, response, 400)
+	response = callRESTWithHeaders("PUT", "/db/etagdoc", `{"prop":3, "_rev":"`+revid2+`"}`,
+		map[string]string{"If-Match": etag})
+	assertStatus(t, response, 400)
+
+	// Delete it using If-Match:
+	response = callRESTWithHeaders("DELETE", "/db/etagdoc?rev="+revid, "",
+		map[string]string{"If-Match": `"` + revid2 + `"`})
+	assertStatus(t, response, 400)
+	response = callRESTWithHeaders("DELETE", "/db/etagdoc", "",
+		map[string]string{"If-Match": `"` + revid2 + `"`})
+	assertStatus(t, response, 200)
+}
+
+func gzipBytes(data string) string {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte(data))
+	writer.Close()
+	return buf.String()
+}
+
+func gunzipResponse(t *testing.T, response *httptest.ResponseRecorder) string {
+	assert.Equals(t, response.Header().Get("Content-Encoding"), "gzip")
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatalf("Invalid gzip response: %v", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Invalid gzip response: %v", err)
+	}
+	return string(data)
+}
+
+func TestGzip(t *testing.T) {
+	// Upload gzipped JSON:
+	gzipHeaders := map[string]string{"Content-Encoding": "gzip"}
+	response := callRESTWithHeaders("PUT", "/db/gzipdoc", gzipBytes(`{"zipped":true}`), gzipHeaders)
+	assertStatus(t, response, 201)
+	response = callRESTWithHeaders("POST", "/db/_bulk_docs",
+		gzipBytes(`{"docs": [{"_id": "gzipbulk1"}, {"_id": "gzipbulk2"}]}`), gzipHeaders)
+	assertStatus(t, response, 201)
+	assertStatus(t, callRESTWithHeaders("PUT", "/db/gzipbad", "not gzip", gzipHeaders), 400)
+
+	// Download it gzipped:
+	acceptHeaders := map[string]string{"Accept-Encoding": "gzip, deflate"}
+	response = callRESTWithHeaders("GET", "/db/gzipdoc", "", acceptHeaders)
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Length"), "")
+	var body db.Body
+	json.Unmarshal([]byte(gunzipResponse(t, response)), &body)
+	assert.Equals(t, body["zipped"], true)
+
+	response = callRESTWithHeaders("GET", "/db/gzipbulk2", "", nil)
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Encoding"), "")
+
+	// A q-value of 0 means gzip isn't acceptable:
+	response = callRESTWithHeaders("GET", "/db/gzipbulk2", "", map[string]string{"Accept-Encoding": "gzip;q=0, deflate"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Encoding"), "")
+	response = callRESTWithHeaders("GET", "/db/gzipbulk2", "", map[string]string{"Accept-Encoding": "gzip; q=0.5"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Encoding"), "gzip")
+	response = callRESTWithHeaders("GET", "/db/gzipbulk2", "", map[string]string{"Accept-Encoding": "*;q=0"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Encoding"), "")
+
+	response = callRESTWithHeaders("GET", "/db/_changes?feed=continuous&limit=1", "", acceptHeaders)
+	assertStatus(t, response, 200)
+	assert.True(t, strings.HasPrefix(gunzipResponse(t, response), `{"seq":`))
+
+	// Errors aren't compressed:
+	response = callRESTWithHeaders("GET", "/db/nosuchgzipdoc", "", acceptHeaders)
+	assertStatus(t, response, 404)
+	assert.Equals(t, response.Header().Get("Content-Encoding"), "")
+}
+
+func TestBulkGetMultipart(t *testing.T) {
+	attachment := strings.Repeat("big attachment data ", 20)
+	response := callRESTWithHeaders("PUT", "/db/bulkgetdoc/big.txt", attachment,
+		map[string]string{"Content-Type": "text/plain"})
+	assertStatus(t, response, 201)
+	createDoc(t, "bulkgetdoc2")
+
+	input := `{"docs": [{"id": "bulkgetdoc"}, {"id": "bulkgetdoc2"}, {"id": "nosuchbulkgetdoc"}]}`
+	response = callREST("POST", "/db/_bulk_get?attachments=true", input)
+	assertStatus(t, response, 200)
+	var result []db.Body
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &result), nil)
+	assert.Equals(t, len(result), 3)
+
+	response = callRESTWithHeaders("POST", "/db/_bulk_get?attachments=true", input,
+		map[string]string{"Accept": "multipart/mixed"})
+	assertStatus(t, response, 200)
+	mediaType, params, _ := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	assert.Equals(t, mediaType, "multipart/mixed")
+	reader := multipart.NewReader(response.Body, params["boundary"])
+
+	// First part is multipart/related, with the attachment following the JSON:
+	part, err := reader.NextPart()
+	assert.Equals(t, err, nil)
+	mediaType, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	assert.Equals(t, mediaType, "multipart/related")
+	related := multipart.NewReader(part, params["boundary"])
+	relatedPart, err := related.NextPart()
+	assert.Equals(t, err, nil)
+	var body db.Body
+	assert.Equals(t, json.NewDecoder(relatedPart).Decode(&body), nil)
+	assert.Equals(t, body["_id"], "bulkgetdoc")
+	relatedPart, err = related.NextPart()
+	assert.Equals(t, err, nil)
+	assert.Equals(t, relatedPart.Header.Get("Content-Type"), "text/plain")
+	data, _ := ioutil.ReadAll(relatedPart)
+	assert.Equals(t, string(data), attachment)
+
+	part, err = reader.NextPart()
+	assert.Equals(t, err, nil)
+	assert.Equals(t, part.Header.Get("Content-Type"), "application/json")
+	body = nil
+	assert.Equals(t, json.NewDecoder(part).Decode(&body), nil)
+	assert.Equals(t, body["_id"], "bulkgetdoc2")
+
+	part, err = reader.NextPart()
+	assert.Equals(t, err, nil)
+	assert.Equals(t, part.Header.Get("Content-Type"), `application/json; error="true"`)
+
+	_, err = reader.NextPart()
+	assert.Equals(t, err, io.EOF)
+}
+
+func TestBulkDocsAllOrNothing(t *testing.T) {
+	input := `{"all_or_nothing": true, "docs": [{"_id": "aondoc1"}, {"_id": "aondoc2"}, {"_id": "aondoc1"}]}`
+	response := callREST("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 400)
+	assertStatus(t, callREST("GET", "/db/aondoc1", ""), 404)
+	assertStatus(t, callREST("GET", "/db/aondoc2", ""), 404)
+
+	input = `{"all_or_nothing": true, "docs": [{"_id": "aondoc1"}, {"_id": "aondoc2"}]}`
+	response = callREST("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+	var docs []db.Body
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 2)
+	assert.Equals(t, docs[1]["id"], "aondoc2")
+	assert.True(t, strings.HasPrefix(docs[1]["rev"].(string), "1-"))
+	assertStatus(t, callREST("GET", "/db/aondoc2", ""), 200)
+}
+
+func TestBulkDocsMultipart(t *testing.T) {
+	attachment := strings.Repeat("following attachment ", 20)
+	digester := sha1.New()
+	digester.Write([]byte(attachment))
+	digestStr := "sha1-" + base64.StdEncoding.EncodeToString(digester.Sum(nil))
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	partHeaders := textproto.MIMEHeader{}
+	partHeaders.Set("Content-Type", "application/json")
+	part, _ := writer.CreatePart(partHeaders)
+	fmt.Fprintf(part, `{"docs": [
+		{"_id": "mpbulk1", "_attachments": {"a.txt": {"follows": true, "digest": %q, "length": %d, "content_type": "text/plain"}}},
+		{"_id": "mpbulk2", "_attachments": {"b.txt": {"follows": true, "digest": %q}}}]}`,
+		digestStr, len(attachment), digestStr)
+	part, _ = writer.CreatePart(textproto.MIMEHeader{})
+	part.Write([]byte(attachment))
+	writer.Close()
+
+	response := callRESTWithHeaders("POST", "/db/_bulk_docs", buffer.String(),
+		map[string]string{"Content-Type": "multipart/related; boundary=" + writer.Boundary()})
+	assertStatus(t, response, 201)
+	var docs []db.Body
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), 2)
+	assert.Equals(t, docs[0]["error"], nil)
+	assert.Equals(t, docs[1]["error"], nil)
+
+	response = callREST("GET", "/db/mpbulk1/a.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), attachment)
+	response = callREST("GET", "/db/mpbulk2/b.txt", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), attachment)
+
+	// A part that doesn't match any attachment is an error:
+	buffer.Reset()
+	writer = multipart.NewWriter(&buffer)
+	part, _ = writer.CreatePart(partHeaders)
+	fmt.Fprintf(part, `{"docs": [{"_id": "mpbulk3", "_attachments": {"a.txt": {"follows": true, "digest": %q}}}]}`, digestStr)
+	part, _ = writer.CreatePart(textproto.MIMEHeader{})
+	part.Write([]byte("something else"))
+	writer.Close()
+	response = callRESTWithHeaders("POST", "/db/_bulk_docs", buffer.String(),
+		map[string]string{"Content-Type": "multipart/related; boundary=" + writer.Boundary()})
+	assertStatus(t, response, 400)
+}
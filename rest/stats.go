@@ -0,0 +1,74 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/db"
+)
+
+// Prefix of metric names in the /_metrics response
+const kMetricsPrefix = "sync_gateway_"
+
+// Statistics about the HTTP requests handled for a database (or for the server itself.)
+type requestStats struct {
+	requests     *base.Counter
+	errors       *base.Counter
+	requestTime  *base.Histogram
+	changesFeeds *base.Counter
+}
+
+func newRequestStats(stats *base.Stats) *requestStats {
+	return &requestStats{
+		requests:     stats.NewCounter("requests_total", "Number of HTTP requests handled."),
+		errors:       stats.NewCounter("request_errors_total", "Number of HTTP requests that failed."),
+		requestTime:  stats.NewHistogram("request_seconds", "Time taken to handle HTTP requests."),
+		changesFeeds: stats.NewGauge("changes_feeds", "Number of open _changes feeds."),
+	}
+}
+
+// Records a request in the stats of its database, or in the server's if it has none.
+func (h *handler) recordRequest(start time.Time, err error) {
+	stats := h.server.requestStats
+	if h.context != nil {
+		stats = h.context.stats
+	}
+	stats.requests.Add(1)
+	if err != nil {
+		stats.errors.Add(1)
+	}
+	stats.requestTime.ObserveSince(start)
+}
+
+// HTTP handler for GET /_stats (admin only.)
+func (h *handler) handleStats() error {
+	databases := db.Body{}
+	for _, name := range h.server.allDatabaseNames() {
+		if context := h.server.getDatabase(name); context != nil {
+			databases[name] = context.dbcontext.Stats.Snapshot()
+		}
+	}
+	h.writeJSON(db.Body{"server": h.server.stats.Snapshot(), "databases": databases})
+	return nil
+}
+
+// HTTP handler for GET /_metrics (admin only): the stats in Prometheus's text format.
+func (h *handler) handleMetrics() error {
+	sets := map[string]*base.Stats{"": h.server.stats}
+	for _, name := range h.server.allDatabaseNames() {
+		if context := h.server.getDatabase(name); context != nil {
+			sets[name] = context.dbcontext.Stats.Stats
+		}
+	}
+	h.setHeader("Content-Type", "text/plain; version=0.0.4")
+	return base.WritePrometheus(h.response, kMetricsPrefix, "db", sets)
+}
@@ -0,0 +1,103 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/db"
+)
+
+var webSocketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(rq *http.Request) bool { return true }, // checked by webSocketOriginAllowed
+}
+
+// Handles _changes?feed=websocket. After the connection is upgraded, the client sends its
+// options as a JSON object (with the same properties as the _changes query parameters); then
+// each change is sent to it as a JSON text message.
+func (h *handler) handleWebSocketChanges() error {
+	if !h.webSocketOriginAllowed() {
+		return &base.HTTPError{http.StatusForbidden, "Origin not allowed"}
+	}
+	conn, err := webSocketUpgrader.Upgrade(h.response, h.rq, nil)
+	if err != nil {
+		return nil // Upgrade has already sent an error response
+	}
+	defer conn.Close()
+
+	var params changesParams
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return nil
+	}
+	if err = json.Unmarshal(message, &params); err != nil {
+		closeWebSocket(conn, websocket.CloseUnsupportedData, "Invalid options")
+		return nil
+	}
+	options, userChannels, err := h.getChangesOptions(params)
+	if err != nil {
+		_, msg := base.ErrorAsHTTPStatus(err)
+		closeWebSocket(conn, websocket.ClosePolicyViolation, msg)
+		return nil
+	}
+
+	// Keep reading from the socket, so we notice when the client closes it:
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	h.logCtx.LogTo("Changes", "WebSocket changes feed for channels %s since %d", userChannels, options.Since)
+	h.generateContinuousChanges(userChannels, options, params.Heartbeat, 0, done,
+		func(entry *db.ChangeEntry) error {
+			if entry == nil {
+				return conn.WriteMessage(websocket.PingMessage, nil) // heartbeat
+			}
+			str, _ := json.Marshal(entry)
+			h.logCtx.LogTo("Changes", "send change: %s", str)
+			return conn.WriteMessage(websocket.TextMessage, str)
+		})
+	closeWebSocket(conn, websocket.CloseNormalClosure, "")
+	return nil
+}
+
+// Browsers send cookies with cross-site WebSocket requests, so (unlike XHR) a page from any
+// origin could read the user's changes feed. Only allow pages from the server's own host or from
+// an origin allowed by the database's CORS config. (Non-browser clients send no Origin.)
+func (h *handler) webSocketOriginAllowed() bool {
+	origin := h.rq.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == h.rq.Host {
+		return true
+	}
+	cors := h.corsConfig(h.PathVars()["db"])
+	return cors != nil && cors.allowsOrigin(origin)
+}
+
+// Sends a close message to the peer.
+func closeWebSocket(conn *websocket.Conn, code int, text string) {
+	message := websocket.FormatCloseMessage(code, text)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}